@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/codegangsta/cli"
+	"github.com/hashicorp/consul/api"
+	"github.com/zanecloud/zlb/api/daemon"
+)
+
+var applyCommand = cli.Command{
+	Name:  "apply",
+	Usage: "make the domains in consul match a yaml or json desired state file",
+	Flags: []cli.Flag{
+		consulAddrFlag,
+		cli.StringFlag{
+			Name:  "file, f",
+			Usage: "desired state file",
+		},
+		cli.BoolFlag{
+			Name:  "prune",
+			Usage: "delete domains which are not in the file",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "only print the plan",
+		},
+	},
+	Action: applyStateCommand,
+}
+
+func applyStateCommand(c *cli.Context) error {
+	if c.String("file") == "" {
+		return cli.NewExitError("Please set --file", 2)
+	}
+	data, err := ioutil.ReadFile(c.String("file"))
+	if err != nil {
+		return err
+	}
+	domains, err := daemon.ParseDesiredState(data)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s: %s", c.String("file"), err.Error()), 2)
+	}
+
+	client, err := api.NewClient(&api.Config{Address: c.String("consul-addr")})
+	if err != nil {
+		return err
+	}
+	changes, err := daemon.PlanApply(client, domains, c.Bool("prune"))
+	if err != nil {
+		return err
+	}
+	printChanges(os.Stdout, changes)
+	if c.Bool("dry-run") || len(changes) == 0 {
+		return nil
+	}
+	if err := daemon.ApplyChanges(client, changes); err != nil {
+		return err
+	}
+	fmt.Printf("%d changes applied\n", len(changes))
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/hashicorp/consul/api"
+	"github.com/zanecloud/zlb/api/daemon"
+	"github.com/zanecloud/zlb/api/types"
+)
+
+var exportCommand = cli.Command{
+	Name:  "export",
+	Usage: "export the whole zlb tree of consul into an archive",
+	Flags: []cli.Flag{
+		consulAddrFlag,
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "archive file, gzip compressed when it ends with .gz (default: stdout)",
+		},
+	},
+	Action: exportTreeCommand,
+}
+
+var restoreCommand = cli.Command{
+	Name:  "restore",
+	Usage: "restore an archive made by export into consul",
+	Flags: []cli.Flag{
+		consulAddrFlag,
+		cli.StringFlag{
+			Name:  "file, f",
+			Usage: "archive file",
+		},
+		cli.StringFlag{
+			Name:  "mode",
+			Value: "merge",
+			Usage: "merge writes the archive over the current tree, replace also deletes keys which are not in the archive",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "only print the plan",
+		},
+	},
+	Action: restoreTreeCommand,
+}
+
+func exportTreeCommand(c *cli.Context) error {
+	client, err := api.NewClient(&api.Config{Address: c.String("consul-addr")})
+	if err != nil {
+		return err
+	}
+	a, err := daemon.Export(client)
+	if err != nil {
+		return err
+	}
+
+	out := c.String("output")
+	if out == "" {
+		return encodeArchive(os.Stdout, a)
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	// the errors of the gzip flush and of the close are those of a
+	// truncated archive, which must not look like a backup
+	if strings.HasSuffix(out, ".gz") {
+		zw := gzip.NewWriter(f)
+		err = encodeArchive(zw, a)
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+	} else {
+		err = encodeArchive(f, a)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func encodeArchive(w io.Writer, a *types.Archive) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(a)
+}
+
+func restoreTreeCommand(c *cli.Context) error {
+	if c.String("file") == "" {
+		return cli.NewExitError("Please set --file", 2)
+	}
+	data, err := ioutil.ReadFile(c.String("file"))
+	if err != nil {
+		return err
+	}
+	a, err := daemon.ReadArchive(data)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s: %s", c.String("file"), err.Error()), 2)
+	}
+
+	client, err := api.NewClient(&api.Config{Address: c.String("consul-addr")})
+	if err != nil {
+		return err
+	}
+	changes, err := daemon.PlanRestore(client, a, c.String("mode"))
+	if err != nil {
+		return err
+	}
+	printChanges(os.Stdout, changes)
+	if c.Bool("dry-run") || len(changes) == 0 {
+		return nil
+	}
+	if err := daemon.ApplyChanges(client, changes); err != nil {
+		return err
+	}
+	fmt.Printf("%d changes applied\n", len(changes))
+	return nil
+}
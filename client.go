@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/codegangsta/cli"
+	"github.com/zanecloud/zlb/api/client"
+)
+
+// exit codes of the client subcommands
+const (
+	exitError       = 1
+	exitUsage       = 2
+	exitNotFound    = 3
+	exitUnreachable = 4
+)
+
+var clientFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "server, s",
+		Value:  "http://localhost:6300",
+		EnvVar: "ZLB_SERVER",
+		Usage:  "zlb api server",
+	},
+	cli.StringFlag{
+		Name:   "token",
+		EnvVar: "ZLB_TOKEN",
+		Usage:  "token sent as bearer authorization",
+	},
+	cli.StringFlag{
+		Name:  "output, o",
+		Value: "table",
+		Usage: "output format (options: table, json)",
+	},
+}
+
+func withClientFlags(flags ...cli.Flag) []cli.Flag {
+	return append(append([]cli.Flag{}, clientFlags...), flags...)
+}
+
+func newClient(c *cli.Context) *client.Client {
+	cl := client.NewClient(c.String("server"))
+	cl.Token = c.String("token")
+	return cl
+}
+
+// exitCode maps the errors of the client package to the exit codes of the
+// client subcommands.
+func exitCode(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch e := err.(type) {
+	case *client.StatusError:
+		switch {
+		case e.StatusCode == 404:
+			return cli.NewExitError(err.Error(), exitNotFound)
+		case e.StatusCode < 500:
+			return cli.NewExitError(err.Error(), exitUsage)
+		}
+	case *client.ConnectionError:
+		return cli.NewExitError(err.Error(), exitUnreachable)
+	}
+	return cli.NewExitError(err.Error(), exitError)
+}
+
+func printJson(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,193 @@
+// Package client calls the routes of a zlb api server.
+//
+//	c := client.NewClient("http://127.0.0.1:6300")
+//	domains, _, err := c.ListDomains(ctx, nil)
+//
+// Every route is a POST. Requests which fail with a transport error or a 5xx
+// status are retried with exponential backoff, other failures are returned
+// at once as a *StatusError or a *ConnectionError. The requests a retry could
+// apply twice, such as creating a webhook or applying a state, are only
+// retried when the connection to the server could not be made.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultMaxRetries = 3
+	DefaultRetryWait  = 500 * time.Millisecond
+)
+
+// Client is safe for concurrent use once configured.
+type Client struct {
+	Address    string // e.g. http://127.0.0.1:6300
+	Token      string // sent as a bearer authorization when not empty
+	HTTPClient *http.Client
+	MaxRetries int           // retries after the first attempt
+	RetryWait  time.Duration // wait before the first retry, doubled after each one
+}
+
+// QueryOptions are the options of the read routes.
+type QueryOptions struct {
+	// RequireConsistent bypasses the cache of the server and reads consul
+	// with a consistent query.
+	RequireConsistent bool
+}
+
+// QueryMeta is returned by the read routes.
+type QueryMeta struct {
+	// LastIndex is the consul index the answer was read at.
+	LastIndex uint64
+}
+
+// WriteOptions are the options of the mutating routes.
+type WriteOptions struct {
+	// DryRun only plans the keys which would be written or deleted.
+	DryRun bool
+}
+
+func NewClient(address string) *Client {
+	address = strings.TrimRight(address, "/")
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	return &Client{
+		Address:    address,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		MaxRetries: DefaultMaxRetries,
+		RetryWait:  DefaultRetryWait,
+	}
+}
+
+func (q *QueryOptions) values() url.Values {
+	v := url.Values{}
+	if q != nil && q.RequireConsistent {
+		v.Set("consistent", "true")
+	}
+	return v
+}
+
+func (w *WriteOptions) values() url.Values {
+	v := url.Values{}
+	if w.dryRun() {
+		v.Set("dry_run", "true")
+	}
+	return v
+}
+
+func (w *WriteOptions) dryRun() bool {
+	return w != nil && w.DryRun
+}
+
+// encodeBody json encodes body unless it is nil or already a []byte.
+func encodeBody(body interface{}) ([]byte, error) {
+	switch b := body.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return b, nil
+	default:
+		return json.Marshal(b)
+	}
+}
+
+// Do posts body to path and returns the answer of a 200 status. It is used
+// by the typed methods and can call routes they do not cover.
+func (c *Client) Do(ctx context.Context, path string, query url.Values, body interface{}) ([]byte, http.Header, error) {
+	return c.request(ctx, "POST", path, query, body)
+}
+
+func (c *Client) request(ctx context.Context, method, path string, query url.Values, body interface{}) ([]byte, http.Header, error) {
+	data, err := encodeBody(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	u := c.Address + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	idempotent := method == "GET" || !unsafeRoutes[path] || query.Get("dry_run") == "true"
+	wait := c.RetryWait
+	for attempt := 0; ; attempt++ {
+		respBody, header, err := c.send(ctx, method, u, path, data)
+		if err == nil || !retryable(err, idempotent) || attempt >= c.MaxRetries {
+			return respBody, header, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// unsafeRoutes are the routes whose request is not idempotent, the others
+// write the same keys with the same values when they are sent again.
+var unsafeRoutes = map[string]bool{
+	"/zlb/webhooks/create": true, // a new ID on every call
+	"/zlb/services/create": true,
+	"/zlb/import/nginx":    true,
+	"/zlb/apply":           true,
+	"/zlb/restore":         true,
+}
+
+func (c *Client) send(ctx context.Context, method, u, path string, data []byte) ([]byte, http.Header, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		return nil, nil, &ConnectionError{Path: path, Err: err, Unsent: dialFailed(err)}
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, &ConnectionError{Path: path, Err: err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, &StatusError{Path: path, StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(respBody))}
+	}
+	return respBody, resp.Header, nil
+}
+
+// call posts body to path and decodes the json answer into out.
+func (c *Client) call(ctx context.Context, path string, query url.Values, body, out interface{}) (http.Header, error) {
+	respBody, header, err := c.Do(ctx, path, query, body)
+	if err != nil {
+		return nil, err
+	}
+	if out != nil {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return nil, err
+		}
+	}
+	return header, nil
+}
+
+func queryMeta(header http.Header) *QueryMeta {
+	index, _ := strconv.ParseUint(header.Get("X-Consul-Index"), 10, 64)
+	return &QueryMeta{LastIndex: index}
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/zanecloud/zlb/api/types"
+)
+
+func domainPath(name, action string) string {
+	return "/zlb/domains/" + url.PathEscape(name) + "/" + action
+}
+
+// write posts a mutating request, the plan is returned on a dry run only.
+func (c *Client) write(ctx context.Context, path string, body interface{}, w *WriteOptions) (*types.ApplyReport, error) {
+	if !w.dryRun() {
+		_, _, err := c.Do(ctx, path, nil, body)
+		return nil, err
+	}
+	report := &types.ApplyReport{}
+	if _, err := c.call(ctx, path, w.values(), body, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (c *Client) ListDomains(ctx context.Context, q *QueryOptions) ([]string, *QueryMeta, error) {
+	var names []string
+	header, err := c.call(ctx, "/zlb/domains/list", q.values(), nil, &names)
+	if err != nil {
+		return nil, nil, err
+	}
+	return names, queryMeta(header), nil
+}
+
+// InspectDomain returns the keys of the domain exploded into a tree, e.g.
+// {"zlb": {"a.com": {"cfg": {"/": "<cfg json>"}, "server": {"/": {"127.0.0.1:80": ""}}}}}.
+func (c *Client) InspectDomain(ctx context.Context, name string, q *QueryOptions) (map[string]interface{}, *QueryMeta, error) {
+	var tree map[string]interface{}
+	header, err := c.call(ctx, domainPath(name, "inspect"), q.values(), nil, &tree)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tree, queryMeta(header), nil
+}
+
+func (c *Client) CreateDomain(ctx context.Context, name string, cfg *types.DomainCfg, w *WriteOptions) (*types.ApplyReport, error) {
+	return c.write(ctx, domainPath(name, "create"), cfg, w)
+}
+
+func (c *Client) UpdateDomain(ctx context.Context, name string, cfg *types.DomainCfg, w *WriteOptions) (*types.ApplyReport, error) {
+	return c.write(ctx, domainPath(name, "update"), cfg, w)
+}
+
+// RemoveDomain removes the domain with all its paths, servers and cookie filters.
+func (c *Client) RemoveDomain(ctx context.Context, name string, w *WriteOptions) (*types.ApplyReport, error) {
+	return c.write(ctx, domainPath(name, "remove"), nil, w)
+}
+
+func (c *Client) SetCookieFilter(ctx context.Context, name string, f *types.CookieFilter, w *WriteOptions) (*types.ApplyReport, error) {
+	return c.write(ctx, domainPath(name, "setCookieFilter"), f, w)
+}
+
+func (c *Client) ListCookieFilters(ctx context.Context, name string, q *QueryOptions) ([]*types.CookieFilter, *QueryMeta, error) {
+	var filters []*types.CookieFilter
+	header, err := c.call(ctx, domainPath(name, "listCookieFilters"), q.values(), nil, &filters)
+	if err != nil {
+		return nil, nil, err
+	}
+	return filters, queryMeta(header), nil
+}
+
+// DeleteCookieFilter deletes the filter on f.Value of the cookie f.Name, or
+// on all its values when f.Value is empty.
+func (c *Client) DeleteCookieFilter(ctx context.Context, name string, f *types.CookieFilter, w *WriteOptions) (*types.ApplyReport, error) {
+	return c.write(ctx, domainPath(name, "deleteCookieFilter"), f, w)
+}
+
+func (c *Client) AddServers(ctx context.Context, name string, servers *types.ServerList, w *WriteOptions) (*types.ApplyReport, error) {
+	return c.write(ctx, domainPath(name, "addServers"), servers, w)
+}
+
+func (c *Client) RemoveServers(ctx context.Context, name string, servers *types.ServerList, w *WriteOptions) (*types.ApplyReport, error) {
+	return c.write(ctx, domainPath(name, "removeServers"), servers, w)
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// StatusError is returned when the server answers with a status other
+// than 200.
+type StatusError struct {
+	Path       string
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: %d %s: %s", e.Path, e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// ConnectionError is returned when the server could not be reached or the
+// answer could not be read.
+type ConnectionError struct {
+	Path string
+	Err  error
+	// Unsent is true when the connection could not be made, the server has
+	// not seen the request.
+	Unsent bool
+}
+
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Err.Error())
+}
+
+// dialFailed reports whether err, of an http.Client, happened while dialing
+// the server.
+func dialFailed(err error) bool {
+	if e, ok := err.(*url.Error); ok {
+		err = e.Err
+	}
+	e, ok := err.(*net.OpError)
+	return ok && e.Op == "dial"
+}
+
+// retryable reports whether a request which failed with err can be sent
+// again, a request which is not idempotent only when the server has not
+// seen it.
+func retryable(err error, idempotent bool) bool {
+	switch e := err.(type) {
+	case *StatusError:
+		return idempotent && e.StatusCode >= 500
+	case *ConnectionError:
+		return idempotent || e.Unsent
+	}
+	return false
+}
+
+func hasStatus(err error, status int) bool {
+	e, ok := err.(*StatusError)
+	return ok && e.StatusCode == status
+}
+
+// IsNotFound reports whether the domain or webhook of a request does not exist.
+func IsNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+// IsBadRequest reports whether the server rejected the content of a request.
+func IsBadRequest(err error) bool {
+	return hasStatus(err, http.StatusBadRequest)
+}
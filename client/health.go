@@ -0,0 +1,84 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/zanecloud/zlb/api/types"
+)
+
+// Version returns the build metadata of the server.
+func (c *Client) Version(ctx context.Context) (*types.VersionInfo, error) {
+	body, _, err := c.request(ctx, "GET", "/version", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	v := &types.VersionInfo{}
+	if err := json.Unmarshal(body, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Ready returns the readiness of the server, it is not retried. A server
+// which is not ready is returned along with its *StatusError.
+func (c *Client) Ready(ctx context.Context) (*types.Readiness, error) {
+	body, _, err := c.send(ctx, "GET", c.Address+"/readyz", "/readyz", nil)
+	if e, ok := err.(*StatusError); ok && e.StatusCode == http.StatusServiceUnavailable {
+		body = []byte(e.Message)
+	} else if err != nil {
+		return nil, err
+	}
+	ready := &types.Readiness{}
+	if jerr := json.Unmarshal(body, ready); jerr != nil {
+		return nil, jerr
+	}
+	return ready, err
+}
+
+// ReportStatus stores the state of the backends seen by an LB node, it
+// replaces the previous report of the node.
+func (c *Client) ReportStatus(ctx context.Context, s *types.NodeStatus, w *WriteOptions) (*types.ApplyReport, error) {
+	return c.write(ctx, "/zlb/status/report", s, w)
+}
+
+// ListNodeStatus returns the last report of every LB node.
+func (c *Client) ListNodeStatus(ctx context.Context) ([]*types.NodeStatus, error) {
+	var nodes []*types.NodeStatus
+	if _, err := c.call(ctx, "/zlb/status/nodes", nil, nil, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// RemoveNodeStatus removes the report of a decommissioned LB node.
+func (c *Client) RemoveNodeStatus(ctx context.Context, node string, w *WriteOptions) (*types.ApplyReport, error) {
+	return c.write(ctx, "/zlb/status/nodes/"+url.PathEscape(node)+"/remove", nil, w)
+}
+
+// DomainStatus returns the nodes which see the servers of a domain up and
+// down.
+func (c *Client) DomainStatus(ctx context.Context, name string, q *QueryOptions) (*types.DomainHealth, *QueryMeta, error) {
+	h := &types.DomainHealth{}
+	header, err := c.call(ctx, domainPath(name, "status"), q.values(), nil, h)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h, queryMeta(header), nil
+}
+
+// ProbeDomain runs the health checks of the paths of a domain, or of path
+// when it is not empty, against their servers now.
+func (c *Client) ProbeDomain(ctx context.Context, name, path string) ([]*types.PathProbe, error) {
+	var query url.Values
+	if path != "" {
+		query = url.Values{"path": {path}}
+	}
+	var probes []*types.PathProbe
+	if _, err := c.call(ctx, domainPath(name, "probe"), query, nil, &probes); err != nil {
+		return nil, err
+	}
+	return probes, nil
+}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/zanecloud/zlb/api/types"
+)
+
+func servicePath(id, action string) string {
+	return "/zlb/services/" + url.PathEscape(id) + "/" + action
+}
+
+// ListServices returns the instances of the services of the consul catalog,
+// with their node.
+func (c *Client) ListServices(ctx context.Context) ([]*types.Service, error) {
+	var services []*types.Service
+	if _, err := c.call(ctx, "/zlb/services/list", nil, nil, &services); err != nil {
+		return nil, err
+	}
+	return services, nil
+}
+
+// RegisterService returns the registered service with its ID, which defaults
+// to its name. A service with the same ID is replaced. A dry run only
+// validates the service.
+func (c *Client) RegisterService(ctx context.Context, s *types.Service, w *WriteOptions) (*types.Service, error) {
+	registered := &types.Service{}
+	if _, err := c.call(ctx, "/zlb/services/create", w.values(), s, registered); err != nil {
+		return nil, err
+	}
+	return registered, nil
+}
+
+// InspectService returns the instance of the catalog with the ID on node, or
+// on the first node which has one when node is empty.
+func (c *Client) InspectService(ctx context.Context, id, node string) (*types.Service, error) {
+	var query url.Values
+	if node != "" {
+		query = url.Values{"node": {node}}
+	}
+	s := &types.Service{}
+	if _, err := c.call(ctx, servicePath(id, "inspect"), query, nil, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// DeregisterService removes the service and its checks. A dry run only checks
+// that the service exists.
+func (c *Client) DeregisterService(ctx context.Context, id string, w *WriteOptions) error {
+	_, _, err := c.Do(ctx, servicePath(id, "deregister"), w.values(), nil)
+	return err
+}
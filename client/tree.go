@@ -0,0 +1,69 @@
+package client
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/zanecloud/zlb/api/types"
+)
+
+func (c *Client) render(ctx context.Context, path, domain string) (string, error) {
+	query := url.Values{}
+	query.Set("domain", domain)
+	body, _, err := c.Do(ctx, path, query, nil)
+	return string(body), err
+}
+
+// RenderNginx returns the nginx configuration of a domain.
+func (c *Client) RenderNginx(ctx context.Context, domain string) (string, error) {
+	return c.render(ctx, "/zlb/render/nginx", domain)
+}
+
+// RenderHaproxy returns the haproxy configuration of a domain.
+func (c *Client) RenderHaproxy(ctx context.Context, domain string) (string, error) {
+	return c.render(ctx, "/zlb/render/haproxy", domain)
+}
+
+// ImportNginx imports the upstreams and server blocks of an nginx configuration.
+func (c *Client) ImportNginx(ctx context.Context, conf []byte, w *WriteOptions) (*types.ImportReport, error) {
+	report := &types.ImportReport{}
+	if _, err := c.call(ctx, "/zlb/import/nginx", w.values(), conf, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Apply makes the declared domains match state, prune deletes the domains
+// which are not declared.
+func (c *Client) Apply(ctx context.Context, state *types.DesiredState, prune bool, w *WriteOptions) (*types.ApplyReport, error) {
+	query := w.values()
+	if prune {
+		query.Set("prune", "true")
+	}
+	report := &types.ApplyReport{}
+	if _, err := c.call(ctx, "/zlb/apply", query, state, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (c *Client) Export(ctx context.Context) (*types.Archive, error) {
+	a := &types.Archive{}
+	if _, err := c.call(ctx, "/zlb/export", nil, nil, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Restore writes an archive, mode is merge or replace.
+func (c *Client) Restore(ctx context.Context, a *types.Archive, mode string, w *WriteOptions) (*types.ApplyReport, error) {
+	query := w.values()
+	if mode != "" {
+		query.Set("mode", mode)
+	}
+	report := &types.ApplyReport{}
+	if _, err := c.call(ctx, "/zlb/restore", query, a, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
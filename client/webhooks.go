@@ -0,0 +1,69 @@
+package client
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/zanecloud/zlb/api/types"
+)
+
+func webhookPath(id, action string) string {
+	return "/zlb/webhooks/" + url.PathEscape(id) + "/" + action
+}
+
+// ListWebhooks returns the webhooks, their secrets are not returned.
+func (c *Client) ListWebhooks(ctx context.Context) ([]*types.Webhook, error) {
+	var hooks []*types.Webhook
+	if _, err := c.call(ctx, "/zlb/webhooks/list", nil, nil, &hooks); err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+// saveWebhook posts the webhook, the plan is returned instead on a dry run.
+func (c *Client) saveWebhook(ctx context.Context, path string, h *types.Webhook, w *WriteOptions) (*types.Webhook, *types.ApplyReport, error) {
+	if w.dryRun() {
+		report := &types.ApplyReport{}
+		if _, err := c.call(ctx, path, w.values(), h, report); err != nil {
+			return nil, nil, err
+		}
+		return nil, report, nil
+	}
+	saved := &types.Webhook{}
+	if _, err := c.call(ctx, path, nil, h, saved); err != nil {
+		return nil, nil, err
+	}
+	return saved, nil, nil
+}
+
+// CreateWebhook returns the webhook with its generated ID, or the plan on a
+// dry run.
+func (c *Client) CreateWebhook(ctx context.Context, h *types.Webhook, w *WriteOptions) (*types.Webhook, *types.ApplyReport, error) {
+	return c.saveWebhook(ctx, "/zlb/webhooks/create", h, w)
+}
+
+func (c *Client) InspectWebhook(ctx context.Context, id string) (*types.Webhook, error) {
+	h := &types.Webhook{}
+	if _, err := c.call(ctx, webhookPath(id, "inspect"), nil, nil, h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// UpdateWebhook replaces the webhook, the secret is kept when h.Secret is empty.
+func (c *Client) UpdateWebhook(ctx context.Context, id string, h *types.Webhook, w *WriteOptions) (*types.Webhook, *types.ApplyReport, error) {
+	return c.saveWebhook(ctx, webhookPath(id, "update"), h, w)
+}
+
+// RemoveWebhook removes the webhook and its dead letters.
+func (c *Client) RemoveWebhook(ctx context.Context, id string, w *WriteOptions) (*types.ApplyReport, error) {
+	return c.write(ctx, webhookPath(id, "remove"), nil, w)
+}
+
+func (c *Client) ListDeadLetters(ctx context.Context, id string) ([]*types.DeadLetter, error) {
+	var letters []*types.DeadLetter
+	if _, err := c.call(ctx, webhookPath(id, "deadletters"), nil, nil, &letters); err != nil {
+		return nil, err
+	}
+	return letters, nil
+}
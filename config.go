@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/zanecloud/zlb/api/daemon"
+	"github.com/zanecloud/zlb/api/opts"
+	"gopkg.in/yaml.v2"
+)
+
+var startFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "config, c",
+		EnvVar: "ZLB_CONFIG",
+		Usage:  "yaml config file whose keys are the names of these flags, read again on SIGHUP",
+	},
+	consulAddrFlag,
+	cli.StringFlag{
+		Name:   "consul-token",
+		EnvVar: "CONSUL_HTTP_TOKEN",
+		Usage:  "consul acl token",
+	},
+	cli.StringFlag{
+		Name:   "addr",
+		EnvVar: "ZLB_ADDR",
+		Value:  "localhost:6300",
+		Usage:  "zlb addr",
+	},
+	cli.StringFlag{
+		Name:   "tls-cert",
+		EnvVar: "ZLB_TLS_CERT",
+		Usage:  "certificate file, the server listens with TLS when set along with --tls-key",
+	},
+	cli.StringFlag{
+		Name:   "tls-key",
+		EnvVar: "ZLB_TLS_KEY",
+		Usage:  "private key file of the certificate",
+	},
+	cli.StringFlag{
+		Name:   "auth-token",
+		EnvVar: "ZLB_AUTH_TOKEN",
+		Usage:  "bearer token required on the zlb routes",
+	},
+	cli.DurationFlag{
+		Name:   "read-timeout",
+		EnvVar: "ZLB_READ_TIMEOUT",
+		Value:  30 * time.Second,
+		Usage:  "time to read a request, 0 for none",
+	},
+	cli.DurationFlag{
+		Name:   "write-timeout",
+		EnvVar: "ZLB_WRITE_TIMEOUT",
+		Value:  60 * time.Second,
+		Usage:  "time to handle a request and write its answer, 0 for none",
+	},
+	cli.DurationFlag{
+		Name:   "idle-timeout",
+		EnvVar: "ZLB_IDLE_TIMEOUT",
+		Value:  2 * time.Minute,
+		Usage:  "time a keep-alive connection is kept idle, 0 for none",
+	},
+	cli.DurationFlag{
+		Name:   "shutdown-timeout",
+		EnvVar: "ZLB_SHUTDOWN_TIMEOUT",
+		Value:  30 * time.Second,
+		Usage:  "time given to the requests in flight to finish on SIGTERM or SIGINT",
+	},
+	cli.StringFlag{
+		Name:   "trace-exporter",
+		EnvVar: "ZLB_TRACE_EXPORTER",
+		Value:  "none",
+		Usage:  "exporter of the spans of the requests and their consul calls (options: none, otlp, file)",
+	},
+	cli.StringFlag{
+		Name:   "trace-endpoint",
+		EnvVar: "ZLB_TRACE_ENDPOINT",
+		Usage:  "url of the OTLP/HTTP collector, http://localhost:4318 by default, or the file of the file exporter",
+	},
+	cli.StringFlag{
+		Name:   "dns-resolver",
+		EnvVar: "ZLB_DNS_RESOLVER",
+		Usage:  "host:port of the nameserver the DNS sources of the domain paths are resolved with, the first of /etc/resolv.conf by default",
+	},
+}
+
+var configCommand = cli.Command{
+	Name:  "config",
+	Usage: "inspect the configuration of the start command",
+	Subcommands: []cli.Command{
+		{
+			Name:   "print",
+			Usage:  "print the effective configuration, secrets redacted",
+			Flags:  startFlags,
+			Action: printConfigCommand,
+		},
+	},
+}
+
+// loadOptions builds the options of the start command and validates them.
+// The precedence is flags, then environment variables, then the config
+// file, then the defaults of the flags.
+func loadOptions(c *cli.Context) (opts.Options, error) {
+	o := opts.Options{
+		Loglevel:        c.GlobalString("log-level"),
+		Address:         c.String("addr"),
+		Consul:          c.String("consul-addr"),
+		ConsulToken:     c.String("consul-token"),
+		TLSCert:         c.String("tls-cert"),
+		TLSKey:          c.String("tls-key"),
+		AuthToken:       c.String("auth-token"),
+		ReadTimeout:     c.Duration("read-timeout"),
+		WriteTimeout:    c.Duration("write-timeout"),
+		IdleTimeout:     c.Duration("idle-timeout"),
+		ShutdownTimeout: c.Duration("shutdown-timeout"),
+		TraceExporter:   c.String("trace-exporter"),
+		TraceEndpoint:   c.String("trace-endpoint"),
+		DNSResolver:     c.String("dns-resolver"),
+		BuildVersion:    Version,
+		GitCommit:       GitCommit,
+		BuildTime:       BuildTime,
+	}
+
+	if file := c.String("config"); file != "" {
+		f, err := opts.ReadFile(file)
+		if err != nil {
+			return o, fmt.Errorf("%s: %s", file, err.Error())
+		}
+		// the flags which are set, on the command line or in the environment,
+		// take precedence over the file
+		str := func(flag string, dst *string, v string) {
+			if v != "" && !c.IsSet(flag) && !c.GlobalIsSet(flag) {
+				*dst = v
+			}
+		}
+		dur := func(flag string, dst *time.Duration, v time.Duration) {
+			if v != 0 && !c.IsSet(flag) && !c.GlobalIsSet(flag) {
+				*dst = v
+			}
+		}
+		str("log-level", &o.Loglevel, f.LogLevel)
+		str("addr", &o.Address, f.Addr)
+		str("consul-addr", &o.Consul, f.ConsulAddr)
+		str("consul-token", &o.ConsulToken, f.ConsulToken)
+		str("tls-cert", &o.TLSCert, f.TLSCert)
+		str("tls-key", &o.TLSKey, f.TLSKey)
+		str("auth-token", &o.AuthToken, f.AuthToken)
+		dur("read-timeout", &o.ReadTimeout, f.ReadTimeout)
+		dur("write-timeout", &o.WriteTimeout, f.WriteTimeout)
+		dur("idle-timeout", &o.IdleTimeout, f.IdleTimeout)
+		dur("shutdown-timeout", &o.ShutdownTimeout, f.ShutdownTimeout)
+		str("trace-exporter", &o.TraceExporter, f.TraceExporter)
+		str("trace-endpoint", &o.TraceEndpoint, f.TraceEndpoint)
+		str("dns-resolver", &o.DNSResolver, f.DNSResolver)
+	}
+	return o, o.Validate()
+}
+
+func printConfigCommand(c *cli.Context) error {
+	o, err := loadOptions(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	data, _ := yaml.Marshal(opts.FileOf(o))
+	fmt.Print(string(data))
+	return nil
+}
+
+func startCommand(c *cli.Context) {
+	options, err := loadOptions(c)
+	if err != nil {
+		logrus.Fatalf("invalid config :%s", err.Error())
+	}
+	options.Reload = func() (opts.Options, error) {
+		return loadOptions(c)
+	}
+	level, _ := logrus.ParseLevel(options.Loglevel)
+	logrus.SetLevel(level)
+
+	daemon.Run(options)
+}
@@ -0,0 +1,85 @@
+package daemon
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/zanecloud/zlb/api/opts"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// ids of the callers are kept when they are reasonable to log
+var validRequestID = regexp.MustCompile(`^[\w.:/+=-]{1,128}$`)
+
+// logger returns the logrus entry of the request ctx belongs to, it carries
+// the request id so that the logs of a request can be correlated.
+func logger(ctx context.Context) *logrus.Entry {
+	if e, ok := ctx.Value(KEY_REQUEST_LOGGER).(*logrus.Entry); ok {
+		return e
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+// withRequestLogger gives the request an id, taken from its X-Request-ID
+// header when there is a valid one, echoes it in the answer and binds a
+// logger tagged with it, and with the trace id of the request when it is
+// traced, to the request context.
+func withRequestLogger(w http.ResponseWriter, r *http.Request) (*http.Request, *logrus.Entry) {
+	id := r.Header.Get(requestIDHeader)
+	if !validRequestID.MatchString(id) {
+		id = newID()
+	}
+	w.Header().Set(requestIDHeader, id)
+	fields := logrus.Fields{"request_id": id}
+	if sp := spanOf(r.Context()); sp != nil {
+		fields["trace_id"] = sp.TraceID
+	}
+	entry := logrus.WithFields(fields)
+	return r.WithContext(context.WithValue(r.Context(), KEY_REQUEST_LOGGER, entry)), entry
+}
+
+// caller names who sent the request, the auth token is the only identity
+// the server knows about.
+func caller(opts opts.Options, route string, r *http.Request) string {
+	if opts.AuthToken != "" && !publicRoutes[route] && authorized(opts, route, r) {
+		return "token"
+	}
+	return "anonymous"
+}
+
+func accessLog(entry *logrus.Entry, opts opts.Options, route string, r *http.Request, rec *statusRecorder, latency time.Duration) {
+	fields := logrus.Fields{
+		"method":     r.Method,
+		"uri":        r.RequestURI,
+		"route":      route,
+		"status":     rec.status,
+		"bytes":      rec.bytes,
+		"latency_ms": float64(latency.Nanoseconds()) / 1e6,
+		"remote":     r.RemoteAddr,
+		"caller":     caller(opts, route, r),
+	}
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		fields["forwarded_for"] = fwd
+	}
+	if ua := r.UserAgent(); ua != "" {
+		fields["user_agent"] = ua
+	}
+	if domain := requestDomain(r); domain != "" {
+		fields["domain"] = domain
+	}
+	entry.WithFields(fields).Info("access")
+}
+
+// requestDomain returns the domain a request is about, from its route or its
+// domain parameter.
+func requestDomain(r *http.Request) string {
+	if domain := mux.Vars(r)["name"]; domain != "" {
+		return domain
+	}
+	return r.URL.Query().Get("domain")
+}
@@ -0,0 +1,230 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/zanecloud/zlb/api/types"
+	"gopkg.in/yaml.v2"
+)
+
+// jsonFields returns the types of the fields of the struct t by their
+// lowercased json name, the names are matched regardless of case by the json
+// decoder.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			for k, v := range jsonFields(ft) {
+				fields[k] = v
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = ft
+	}
+	return fields
+}
+
+// unknownField returns an error for the first object key of doc which is not
+// a field of t, at is the location of doc in the document.
+func unknownField(doc interface{}, t reflect.Type, at string) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch doc := doc.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(doc))
+		for k := range doc {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var fields map[string]reflect.Type
+		if t.Kind() == reflect.Struct {
+			fields = jsonFields(t)
+		}
+		for _, k := range keys {
+			ft := t
+			switch t.Kind() {
+			case reflect.Map:
+				ft = t.Elem()
+			case reflect.Struct:
+				var ok bool
+				if ft, ok = fields[strings.ToLower(k)]; !ok {
+					return fmt.Errorf("json: unknown field %q in %s", k, at)
+				}
+			default:
+				return nil
+			}
+			if err := unknownField(doc[k], ft, at+"."+k); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for i, v := range doc {
+				if err := unknownField(v, t.Elem(), fmt.Sprintf("%s[%d]", at, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// unmarshalStrictJSON decodes data into v and fails on the keys which are not
+// a field of v, as yaml.UnmarshalStrict does. The json decoder of the
+// toolchain zlb-api is built with cannot refuse them itself.
+func unmarshalStrictJSON(data []byte, v interface{}) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	var doc interface{}
+	json.Unmarshal(data, &doc)
+	return unknownField(doc, reflect.TypeOf(v), "$")
+}
+
+// ParseDesiredState decodes an apply file, json documents are recognized by
+// their leading brace, anything else is read as yaml. Both refuse the keys
+// which are not a field of the state.
+func ParseDesiredState(data []byte) ([]*types.Domain, error) {
+	state := &types.DesiredState{}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		if err := unmarshalStrictJSON(data, state); err != nil {
+			return nil, err
+		}
+	} else if err := yaml.UnmarshalStrict(data, state); err != nil {
+		return nil, err
+	}
+
+	var domains []*types.Domain
+	seen := map[string]bool{}
+	for _, spec := range state.Domains {
+		if spec.Name == "" || strings.Contains(spec.Name, "/") {
+			return nil, fmt.Errorf("invalid domain name %q", spec.Name)
+		}
+		if seen[spec.Name] {
+			return nil, fmt.Errorf("domain %s is declared twice", spec.Name)
+		}
+		seen[spec.Name] = true
+
+		d := &types.Domain{Name: spec.Name, Paths: map[string]*types.DomainPath{}, CookieFilters: spec.CookieFilters}
+		for _, ps := range spec.Paths {
+			path := ps.Path
+			if path == "" {
+				path = "/"
+			}
+			if _, ok := d.Paths[path]; ok {
+				return nil, fmt.Errorf("domain %s: path %s is declared twice", spec.Name, path)
+			}
+			if err := ps.DomainCfg.Validate(); err != nil {
+				return nil, fmt.Errorf("domain %s: path %s: %s", spec.Name, path, err.Error())
+			}
+			if ps.Synced() && len(ps.Servers) > 0 {
+				return nil, fmt.Errorf("domain %s: path %s: the servers of a path with a Service or a DNS source are synced", spec.Name, path)
+			}
+			for _, s := range ps.Servers {
+				if _, _, err := net.SplitHostPort(s); err != nil {
+					return nil, fmt.Errorf("domain %s: path %s: invalid server %q", spec.Name, path, s)
+				}
+			}
+			cfg := ps.DomainCfg
+			cfg.Path = path
+			p := d.EnsurePath(path)
+			p.Cfg = &cfg
+			p.Servers = ps.Servers
+		}
+		for _, f := range d.CookieFilters {
+			if err := f.Validate(); err != nil {
+				return nil, fmt.Errorf("domain %s: cookie filter: %s", spec.Name, err.Error())
+			}
+		}
+		domains = append(domains, d)
+	}
+	return domains, nil
+}
+
+// PlanApply computes the changes which make the zlb/ tree match domains.
+// Declared domains are owned by the file, their keys which are not declared
+// are deleted. Domains which are not declared are deleted only with prune.
+// The servers of the paths with a source are left to the discovery.
+func PlanApply(client *api.Client, domains []*types.Domain, prune bool) ([]*types.KVChange, error) {
+	declared := map[string]bool{}
+	var synced []string
+	for _, d := range domains {
+		declared[d.Name] = true
+		for _, p := range d.Paths {
+			if p.Cfg != nil && p.Cfg.Synced() {
+				synced = append(synced, fmt.Sprintf("%s%s/server/%s/", zlbPrefix, d.Name, encodePath(p.Path)))
+			}
+		}
+	}
+	return planDomains(client, domains, func(key string) bool {
+		for _, prefix := range synced {
+			if strings.HasPrefix(key, prefix) {
+				return false
+			}
+		}
+		name := strings.SplitN(strings.TrimPrefix(key, zlbPrefix), "/", 2)[0]
+		return prune || declared[name]
+	})
+}
+
+// ApplyChanges writes a plan computed by PlanApply.
+func ApplyChanges(client *api.Client, changes []*types.KVChange) error {
+	return applyChanges(context.Background(), client, changes)
+}
+
+func applyState(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	client, _ := ctx.Value(KEY_CONSUL_CLIENT).(*api.Client)
+	dryRun := isDryRun(r)
+	prune, _ := strconv.ParseBool(r.URL.Query().Get("prune"))
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	domains, err := ParseDesiredState(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	changes, err := PlanApply(client, domains, prune)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !dryRun {
+		if err := applyChanges(ctx, client, changes); err != nil {
+			logger(ctx).Infof("apply fail :%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJson(w, &types.ApplyReport{Changes: changes, DryRun: dryRun})
+}
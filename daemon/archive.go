@@ -0,0 +1,213 @@
+package daemon
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/zanecloud/zlb/api/types"
+)
+
+// rawJson keeps a json value as is, anything else is stored as a json string.
+func rawJson(v []byte) json.RawMessage {
+	var buf bytes.Buffer
+	if json.Compact(&buf, v) == nil && !bytes.HasPrefix(buf.Bytes(), []byte(`"`)) {
+		return buf.Bytes()
+	}
+	raw, _ := json.Marshal(string(v))
+	return raw
+}
+
+func archiveDomain(a *types.Archive, name string) *types.ArchiveDomain {
+	d, ok := a.Domains[name]
+	if !ok {
+		d = &types.ArchiveDomain{}
+		a.Domains[name] = d
+	}
+	return d
+}
+
+func nested(m map[string]map[string]string, k1, k2, v string) map[string]map[string]string {
+	if m == nil {
+		m = map[string]map[string]string{}
+	}
+	if m[k1] == nil {
+		m[k1] = map[string]string{}
+	}
+	m[k1][k2] = v
+	return m
+}
+
+// archivePath decodes the path of a key, ok is false when the path would
+// not be encoded back into the same key.
+func archivePath(seg string) (string, bool) {
+	path := decodePath(seg)
+	return path, encodePath(path) == seg
+}
+
+// NewArchive builds the archive of the pairs of the zlb/ tree. The keys which
+// would not be restored as they are, such as the paths which are not
+// encoded, are kept in Other.
+func NewArchive(pairs api.KVPairs) *types.Archive {
+	a := &types.Archive{Version: types.ArchiveVersion, Time: time.Now().Unix(), Domains: map[string]*types.ArchiveDomain{}}
+	for _, pair := range pairs {
+		parts := strings.Split(strings.TrimPrefix(pair.Key, zlbPrefix), "/")
+		path, encoded := "", false
+		if len(parts) > 2 {
+			path, encoded = archivePath(parts[2])
+		}
+		switch {
+		case len(parts) == 3 && parts[0] != "" && parts[1] == "cfg" && encoded:
+			d := archiveDomain(a, parts[0])
+			if d.Cfg == nil {
+				d.Cfg = map[string]json.RawMessage{}
+			}
+			d.Cfg[path] = rawJson(pair.Value)
+		case len(parts) == 4 && parts[0] != "" && parts[1] == "server" && encoded:
+			d := archiveDomain(a, parts[0])
+			d.Server = nested(d.Server, path, parts[3], string(pair.Value))
+		case len(parts) == 4 && parts[0] != "" && parts[1] == "ckfilter":
+			d := archiveDomain(a, parts[0])
+			d.Ckfilter = nested(d.Ckfilter, parts[2], parts[3], string(pair.Value))
+		default:
+			if a.Other == nil {
+				a.Other = map[string]string{}
+			}
+			a.Other[pair.Key] = string(pair.Value)
+		}
+	}
+	return a
+}
+
+// archivePairs returns the keys and values the archive restores.
+func archivePairs(a *types.Archive) map[string]string {
+	pairs := map[string]string{}
+	for name, d := range a.Domains {
+		for path, raw := range d.Cfg {
+			var s string
+			if json.Unmarshal(raw, &s) != nil {
+				var buf bytes.Buffer
+				json.Compact(&buf, raw)
+				s = buf.String()
+			}
+			pairs[cfgKey(name, path)] = s
+		}
+		for path, servers := range d.Server {
+			for server, v := range servers {
+				pairs[serverKey(name, path, server)] = v
+			}
+		}
+		for ck, values := range d.Ckfilter {
+			for value, lifecycle := range values {
+				pairs[ckfilterKey(name, ck, value)] = lifecycle
+			}
+		}
+	}
+	for k, v := range a.Other {
+		pairs[k] = v
+	}
+	return pairs
+}
+
+// ReadArchive decodes an archive, gzip compressed or not.
+func ReadArchive(data []byte) (*types.Archive, error) {
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = ioutil.ReadAll(zr); err != nil {
+			return nil, err
+		}
+	}
+	a := &types.Archive{}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, err
+	}
+	if a.Version != types.ArchiveVersion {
+		return nil, fmt.Errorf("unsupported archive version %d", a.Version)
+	}
+	for k := range a.Other {
+		if !strings.HasPrefix(k, zlbPrefix) {
+			return nil, fmt.Errorf("archive key %s is outside of %s", k, zlbPrefix)
+		}
+	}
+	return a, nil
+}
+
+// Export reads the whole zlb/ tree with a consistent query.
+func Export(client *api.Client) (*types.Archive, error) {
+	pairs, _, err := client.KV().List(zlbPrefix, &api.QueryOptions{RequireConsistent: true})
+	if err != nil {
+		return nil, err
+	}
+	return NewArchive(pairs), nil
+}
+
+// PlanRestore plans the restore of an archive. In merge mode the archive keys
+// are written over the current tree, in replace mode the keys which are not
+// in the archive are deleted too. The plan is written with applyChanges, a
+// restore which fails is rolled back rather than leaving a mix of the current
+// and the archived tree.
+func PlanRestore(client *api.Client, a *types.Archive, mode string) ([]*types.KVChange, error) {
+	var prune func(string) bool
+	switch mode {
+	case "", "merge":
+	case "replace":
+		prune = func(string) bool { return true }
+	default:
+		return nil, fmt.Errorf("invalid restore mode %q (options: merge, replace)", mode)
+	}
+	current, _, err := client.KV().List(zlbPrefix, &api.QueryOptions{RequireConsistent: true})
+	if err != nil {
+		return nil, err
+	}
+	return planChanges(current, archivePairs(a), prune), nil
+}
+
+func exportTree(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	client, _ := ctx.Value(KEY_CONSUL_CLIENT).(*api.Client)
+	a, err := Export(client)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=zlb-%d.json", a.Time))
+	writeJson(w, a)
+}
+
+func restoreTree(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	client, _ := ctx.Value(KEY_CONSUL_CLIENT).(*api.Client)
+	dryRun := isDryRun(r)
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a, err := ReadArchive(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	changes, err := PlanRestore(client, a, r.URL.Query().Get("mode"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !dryRun {
+		if err := applyChanges(ctx, client, changes); err != nil {
+			logger(ctx).Infof("restore fail :%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJson(w, &types.ApplyReport{Changes: changes, DryRun: dryRun})
+}
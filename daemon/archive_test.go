@@ -0,0 +1,45 @@
+package daemon
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// an archive restores every key of the tree as it was exported.
+func TestArchiveRoundTrip(t *testing.T) {
+	want := map[string]string{
+		cfgKey("a.com", "/"):                      `{"Healthcheck":{"Type":"tcp"},"Path":"/"}`,
+		cfgKey("a.com", "/api"):                   "not json",
+		serverKey("a.com", "/", "10.0.0.1:80"):    "",
+		serverKey("a.com", "/api", "10.0.0.2:80"): "",
+		ckfilterKey("a.com", "uid", "42"):         "3600",
+		// the keys of the paths which are not encoded, or not as
+		// encodePath encodes them, are not domain paths
+		zlbPrefix + "a.com/cfg/legacy":                `{"Path":"/legacy"}`,
+		zlbPrefix + "a.com/server/legacy/10.0.0.3:80": "",
+		zlbPrefix + "a.com/cfg/path_%%%":              "{}",
+		zlbPrefix + "a.com/cfg/path_L2E":              "{}",
+		zlbPrefix + "a.com/cfg/path_":                 "{}",
+		zlbPrefix + "a.com/other":                     "x",
+	}
+	var pairs api.KVPairs
+	for k, v := range want {
+		pairs = append(pairs, &api.KVPair{Key: k, Value: []byte(v)})
+	}
+
+	a := NewArchive(pairs)
+	if got := archivePairs(a); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	d := a.Domains["a.com"]
+	if d == nil || len(d.Cfg) != 2 || len(d.Server) != 2 {
+		t.Fatalf("got domain %+v, want the paths / and /api", d)
+	}
+	for _, k := range []string{zlbPrefix + "a.com/cfg/legacy", zlbPrefix + "a.com/server/legacy/10.0.0.3:80", zlbPrefix + "a.com/cfg/path_L2E"} {
+		if _, ok := a.Other[k]; !ok {
+			t.Errorf("%s is not kept in Other", k)
+		}
+	}
+}
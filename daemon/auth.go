@@ -0,0 +1,30 @@
+package daemon
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/zanecloud/zlb/api/opts"
+)
+
+// publicRoutes answer without the auth token, orchestrators and scrapers
+// probe them without credentials.
+var publicRoutes = map[string]bool{
+	"/healthz":   true,
+	"/readyz":    true,
+	"/version":   true,
+	"/metrics":   true,
+	openAPIPath:  true,
+	explorerPath: true,
+}
+
+// authorized checks the bearer token of a request when the server is
+// configured with one.
+func authorized(opts opts.Options, route string, r *http.Request) bool {
+	if opts.AuthToken == "" || publicRoutes[route] {
+		return true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(opts.AuthToken)) == 1
+}
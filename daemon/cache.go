@@ -0,0 +1,35 @@
+package daemon
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// readTree returns the pairs under prefix and the consul index they reflect.
+// Reads are served from the in-process copy of the zlb/ tree kept by the
+// tree watcher, unless the caller asks for ?consistent=true or the watcher
+// has not synced yet, in which case consul is queried directly.
+func readTree(ctx context.Context, r *http.Request, prefix string) (api.KVPairs, uint64, error) {
+	consistent, _ := strconv.ParseBool(r.URL.Query().Get("consistent"))
+	if !consistent {
+		if cache, ok := ctx.Value(KEY_TREE_CACHE).(*treeWatcher); ok {
+			if pairs, index, ok := cache.Snapshot(prefix); ok {
+				return pairs, index, nil
+			}
+		}
+	}
+
+	client, _ := ctx.Value(KEY_CONSUL_CLIENT).(*api.Client)
+	pairs, meta, err := client.KV().List(prefix, &api.QueryOptions{RequireConsistent: consistent})
+	if err != nil {
+		return nil, 0, err
+	}
+	return pairs, meta.LastIndex, nil
+}
+
+func setIndexHeader(w http.ResponseWriter, index uint64) {
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+}
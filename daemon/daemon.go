@@ -9,41 +9,22 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/hashicorp/consul/api"
 	"github.com/zanecloud/zlb/api/opts"
+	"github.com/zanecloud/zlb/api/types"
 	"net/http"
 	"strings"
+	"sync"
 )
 
 const KEY_CONSUL_CLIENT = "consul.client"
 const KEY_SERVER_OPTS = "server.opts"
-
-
+const KEY_TREE_CACHE = "tree.cache"
+const KEY_REQUEST_LOGGER = "request.logger"
+const KEY_ROUTERS = "server.routers"
+const KEY_READY_CLIENT = "consul.ready.client"
+const KEY_LOCK_CLIENT = "consul.lock.client"
 
 type Handler func(c context.Context, w http.ResponseWriter, r *http.Request)
 
-type HealthCheckCfg struct {
-	Type           string `json:"Type"`
-	Uri            string `json:"Uri,omitempty"`
-	Valid_statuses string `json:"Valid_statuses,omitempty"`
-	Interval       int    `json:"Interval,omitempty"`
-	Timeout        int    `json:"Timeout,omitempty"`
-	Fall           int    `json:"Fall,omitempty"`
-	Rise           int    `json:"Rise,omitempty"`
-	Concurrency    int    `json:"Concurrency,omitempty"`
-}
-
-type DomainCfg struct {
-	Healthcheck  HealthCheckCfg `json:"Healthcheck"`
-	Sticky bool  `json:"Sticky,omitempty"`
-	KeepAlive int `json:"KeepAlive,omitempty"`
-    Path string `json:"Path,omitempty"`
-}
-
-type CookieFilter struct {
-	Name      string `json:"Name"`
-	Value     string `json:"Value"`
-	Lifecycle int64  `json:"Lifecycle"`
-}
-
 func explodeHelper(m map[string]interface{}, k, v, p string) error {
 	if strings.Contains(k, "/") {
 		parts := strings.Split(k, "/")
@@ -76,9 +57,8 @@ func explodeHelper(m map[string]interface{}, k, v, p string) error {
 }
 
 func getDomainJson(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	client, _ := ctx.Value(KEY_CONSUL_CLIENT).(*api.Client)
 	name := mux.Vars(r)["name"]
-	pairs, _, err := client.KV().List("zlb/" + name + "/", nil)
+	pairs, index, err := readTree(ctx, r, "zlb/"+name+"/")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -92,26 +72,29 @@ func getDomainJson(ctx context.Context, w http.ResponseWriter, r *http.Request)
 	}
 
 	jsonstr, _ := json.Marshal(m)
-	w.WriteHeader(http.StatusOK)
+	setIndexHeader(w, index)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(jsonstr))
 }
 
 func getDomainList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	client, _ := ctx.Value(KEY_CONSUL_CLIENT).(*api.Client)
-	keys, _, err := client.KV().Keys("zlb/", "/", nil)
+	pairs, index, err := readTree(ctx, r, "zlb/")
 	var dynaArr []string
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	for _, key := range keys {
-		v := strings.Split(key, "/")
+	for _, pair := range pairs {
+		v := strings.Split(pair.Key, "/")
 		domainName := v[1]
-		dynaArr = append(dynaArr, domainName)
+		if len(dynaArr) == 0 || dynaArr[len(dynaArr)-1] != domainName {
+			dynaArr = append(dynaArr, domainName)
+		}
 	}
-	w.WriteHeader(http.StatusOK)
+	setIndexHeader(w, index)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	jsonstr, _ := json.Marshal(dynaArr)
 	w.Write([]byte(jsonstr))
 }
@@ -126,11 +109,15 @@ func updateDomain(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Please set DomainName in URI ", 404)
 		return
 	}
-	req := &DomainCfg{}
+	req := &types.DomainCfg{}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if err := req.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	path := req.Path
 	if (path == "" ) {
 	   	path = "/";
@@ -138,13 +125,18 @@ func updateDomain(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	path = "path_" + base64.URLEncoding.EncodeToString([]byte(path))
 
 	jsonstr, _ := json.Marshal(req)
+	consulkey := fmt.Sprintf("zlb/%s/cfg/%s", domainName, path)
+	if isDryRun(r) {
+		writeDryRun(w, client, map[string]string{consulkey: string(jsonstr)}, nil)
+		return
+	}
 	_, err := client.KV().Put(&api.KVPair{
-		Key:   fmt.Sprintf("zlb/%s/cfg/%s", domainName,path),
+		Key:   consulkey,
 		Value: jsonstr,
 	}, nil)
 
 	if err != nil {
-		logrus.WithFields(logrus.Fields{"domainname": domainName}).Infof("put consule fail :%s", err.Error())
+		logger(ctx).WithFields(logrus.Fields{"domainname": domainName}).Infof("put consule fail :%s", err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -160,20 +152,28 @@ func setCookieFilter(ctx context.Context, w http.ResponseWriter, r *http.Request
 		http.Error(w, "Please set DomainName in URI ", 404)
 		return
 	}
-	req := &CookieFilter{}
+	req := &types.CookieFilter{}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if err := req.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	consulkey := fmt.Sprintf("zlb/%s/ckfilter/%s/%s", domainName, req.Name, req.Value)
+	if isDryRun(r) {
+		writeDryRun(w, client, map[string]string{consulkey: fmt.Sprintf("%d", req.Lifecycle)}, nil)
+		return
+	}
 	_, err := client.KV().Put(&api.KVPair{
 		Key:   consulkey,
 		Value: []byte(fmt.Sprintf("%d", req.Lifecycle)),
 	}, nil)
 
 	if err != nil {
-		logrus.WithFields(logrus.Fields{"consulkey": consulkey}).Infof("put consule fail :%s", err.Error())
+		logger(ctx).WithFields(logrus.Fields{"consulkey": consulkey}).Infof("put consule fail :%s", err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -190,10 +190,14 @@ func removeDomain(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	}
 
 	consulkey := fmt.Sprintf("zlb/%s", domainName)
+	if isDryRun(r) {
+		writeDryRun(w, client, nil, []string{consulkey + "/"})
+		return
+	}
 	_, err := client.KV().DeleteTree(consulkey+"/", nil)
 
 	if err != nil {
-		logrus.WithFields(logrus.Fields{"consulkey": consulkey}).Infof("delete consule  fail :%s", err.Error())
+		logger(ctx).WithFields(logrus.Fields{"consulkey": consulkey}).Infof("delete consule  fail :%s", err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -205,14 +209,46 @@ func removeDomain(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 
 var routers = map[string]map[string]Handler{
 	"HEAD": {},
-	"GET":  {},
+	"GET": {
+		"/metrics":   getMetrics,
+		"/healthz":   getHealthz,
+		"/readyz":    getReadyz,
+		"/version":   getVersion,
+		openAPIPath:  getOpenAPI,
+		explorerPath: getExplorer,
+	},
 	"POST": {
-		"/zlb/domains/list":                      getDomainList,
-		"/zlb/domains/{name:.*}/inspect":         getDomainJson,
-		"/zlb/domains/{name:.*}/create":          updateDomain,
-		"/zlb/domains/{name:.*}/update":          updateDomain,
-		"/zlb/domains/{name:.*}/remove":          removeDomain,
-		"/zlb/domains/{name:.*}/setCookieFilter": setCookieFilter,
+		"/zlb/domains/list":                         getDomainList,
+		"/zlb/domains/{name:.*}/inspect":            getDomainJson,
+		"/zlb/domains/{name:.*}/create":             updateDomain,
+		"/zlb/domains/{name:.*}/update":             updateDomain,
+		"/zlb/domains/{name:.*}/remove":             removeDomain,
+		"/zlb/domains/{name:.*}/setCookieFilter":    setCookieFilter,
+		"/zlb/domains/{name:.*}/listCookieFilters":  getCookieFilterList,
+		"/zlb/domains/{name:.*}/deleteCookieFilter": deleteCookieFilter,
+		"/zlb/domains/{name:.*}/addServers":         addServers,
+		"/zlb/domains/{name:.*}/removeServers":      removeServers,
+		"/zlb/domains/{name:.*}/status":             getDomainHealth,
+		"/zlb/domains/{name:.*}/probe":              probeDomain,
+		"/zlb/render/nginx":                         renderHandler(RenderNginx),
+		"/zlb/render/haproxy":                       renderHandler(RenderHaproxy),
+		"/zlb/import/nginx":                         importNginx,
+		"/zlb/apply":                                applyState,
+		"/zlb/export":                               exportTree,
+		"/zlb/restore":                              restoreTree,
+		"/zlb/webhooks/list":                        getWebhookList,
+		"/zlb/webhooks/create":                      saveWebhook,
+		"/zlb/webhooks/{id}/inspect":                getWebhookJson,
+		"/zlb/webhooks/{id}/update":                 saveWebhook,
+		"/zlb/webhooks/{id}/remove":                 removeWebhook,
+		"/zlb/webhooks/{id}/deadletters":            getDeadLetterList,
+		"/zlb/services/list":                        getServiceList,
+		"/zlb/services/create":                      registerService,
+		"/zlb/services/{id}/inspect":                getServiceJson,
+		"/zlb/services/{id}/deregister":             deregisterService,
+		"/zlb/status/report":                        reportStatus,
+		"/zlb/status/nodes":                         getNodeStatusList,
+		"/zlb/status/nodes/{node}/remove":           removeNodeStatus,
 	},
 	"PUT":     {},
 	"DELETE":  {},
@@ -221,11 +257,57 @@ var routers = map[string]map[string]Handler{
 
 func Run(opts opts.Options) {
 
-	consulClient, err := api.NewClient(&api.Config{Address: opts.Consul})
+	transport := &consulTransport{next: api.DefaultConfig().Transport}
+	consulClient, err := newConsulClient(opts, transport)
 	if err != nil {
 		logrus.Fatalf("create a consul client error:%s", err.Error())
 		return
 	}
+	readyClient, err := newReadyClient(opts, transport)
+	if err != nil {
+		logrus.Fatalf("create a consul client error:%s", err.Error())
+		return
+	}
+	tracer, err := newTracer(opts)
+	if err != nil {
+		logrus.Fatalf("create a tracer error:%s", err.Error())
+		return
+	}
+
+	workers, stop := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	webhooks := newLeader(consulClient, webhookLockKey)
+	dispatcher := newWebhookDispatcher(workers, consulClient, webhooks)
+	watcher := newTreeWatcher(consulClient)
+	resolver := opts.DNSResolver
+	if resolver == "" {
+		resolver = systemResolver()
+	}
+	discovery := newDiscovery(consulClient, watcher, resolver)
+	watcher.OnChange(dispatcher.Dispatch)
+	watcher.OnChange(discovery.Notify)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		watcher.Run(workers)
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		webhooks.Run(workers, nil)
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		newLeader(consulClient, discoveryLockKey).Run(workers, discovery.Run)
+	}()
+	if tracer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tracer.Run(workers)
+		}()
+	}
 
 	r := mux.NewRouter()
 	for method, mappings := range routers {
@@ -235,26 +317,41 @@ func Run(opts opts.Options) {
 			localRoute := route
 			localFct := fct
 			wrap := func(w http.ResponseWriter, req *http.Request) {
-				logrus.WithFields(logrus.Fields{"method": req.Method, "uri": req.RequestURI}).Debug("HTTP request received")
+				logger(req.Context()).WithFields(logrus.Fields{"method": req.Method, "uri": req.RequestURI}).Debug("HTTP request received")
 
 				ctx := context.WithValue(req.Context(), KEY_SERVER_OPTS, opts)
-				ctx = context.WithValue(ctx, KEY_CONSUL_CLIENT, consulClient)
+				client := tracer.tracedConsulClient(req.Context(), opts, consulClient, transport)
+				ctx = context.WithValue(ctx, KEY_CONSUL_CLIENT, client)
+				ctx = context.WithValue(ctx, KEY_LOCK_CLIENT, consulClient)
+				ctx = context.WithValue(ctx, KEY_TREE_CACHE, watcher)
+				ctx = context.WithValue(ctx, KEY_ROUTERS, routers)
+				ctx = context.WithValue(ctx, KEY_READY_CLIENT, readyClient)
+
+				if !authorized(opts, localRoute, req) {
+					w.Header().Set("WWW-Authenticate", `Bearer realm="zlb-api"`)
+					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+					return
+				}
 
 				localFct(ctx, w, req)
 			}
 			localMethod := method
 
 			//r.Path("/v{version:[0-9.]+}" + localRoute).Methods(localMethod).HandlerFunc(wrap)
-			r.Path(localRoute).Methods(localMethod).HandlerFunc(wrap)
+			r.Path(localRoute).Methods(localMethod).HandlerFunc(instrument(opts, tracer, localRoute, wrap))
 		}
 	}
 
-	srv := http.Server{
-		Handler: r,
-		Addr:    opts.Address,
+	srv := &http.Server{
+		Handler:      r,
+		Addr:         opts.Address,
+		ReadTimeout:  opts.ReadTimeout,
+		WriteTimeout: opts.WriteTimeout,
+		IdleTimeout:  opts.IdleTimeout,
 	}
 
-	if err := srv.ListenAndServe(); err != nil {
-		logrus.Errorf("run zlb api err:%s", err.Error())
-	}
+	serve(srv, opts, stop, func() {
+		wg.Wait()
+		dispatcher.Wait()
+	})
 }
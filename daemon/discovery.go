@@ -0,0 +1,313 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+	"github.com/zanecloud/zlb/api/types"
+)
+
+const (
+	discoveryResyncInterval = 30 * time.Second
+
+	// held by the instance which syncs the servers
+	discoveryLockKey = "zlb-api/locks/discovery"
+
+	// bounds of the time a dns name is resolved again after, its TTL
+	// otherwise
+	dnsMinInterval = 5 * time.Second
+	dnsMaxInterval = 5 * time.Minute
+)
+
+// discovery keeps the servers of the domain paths which have a source in
+// their cfg in sync with it. It follows the zlb/ tree through the watcher to
+// start and stop a sync loop per path as the cfgs change.
+type discovery struct {
+	client   *api.Client
+	watcher  *treeWatcher
+	resolver string
+	kick     chan struct{}
+
+	wg    sync.WaitGroup
+	loops map[string]*discoveryLoop
+}
+
+type discoveryLoop struct {
+	source string // the json of the source, a change restarts the loop
+	cancel context.CancelFunc
+}
+
+// newDiscovery returns a discovery which resolves the dns sources with the
+// nameserver at resolver, host:port.
+func newDiscovery(client *api.Client, watcher *treeWatcher, resolver string) *discovery {
+	return &discovery{
+		client:   client,
+		watcher:  watcher,
+		resolver: resolver,
+		kick:     make(chan struct{}, 1),
+		loops:    map[string]*discoveryLoop{},
+	}
+}
+
+// cfgSource returns the json of the source of the servers of cfg.
+func cfgSource(cfg *types.DomainCfg) string {
+	return jsonOf([]interface{}{cfg.Service, cfg.DNS})
+}
+
+// Notify is a listener of the watcher, a cfg change starts a reconcile.
+func (d *discovery) Notify(events []*types.ChangeEvent) {
+	for _, e := range events {
+		if e.Type == "cfg" {
+			select {
+			case d.kick <- struct{}{}:
+			default:
+			}
+			return
+		}
+	}
+}
+
+// Run reconciles the sync loops with the cfgs when they change, and
+// periodically since the first snapshot of the watcher is not a change. It
+// returns once the loops are stopped. It is run by the instance which holds
+// the discovery lock, again after the lock was lost and acquired back.
+func (d *discovery) Run(ctx context.Context) {
+	ticker := time.NewTicker(discoveryResyncInterval)
+	defer ticker.Stop()
+	for {
+		d.reconcile(ctx)
+		select {
+		case <-ctx.Done():
+			d.wg.Wait()
+			d.loops = map[string]*discoveryLoop{}
+			return
+		case <-d.kick:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *discovery) reconcile(ctx context.Context) {
+	pairs, _, ok := d.watcher.Snapshot(zlbPrefix)
+	if !ok {
+		return
+	}
+	domains, err := ParseDomains(pairs)
+	if err != nil {
+		logrus.Warnf("discovery: %s", err.Error())
+		return
+	}
+
+	wanted := map[string]bool{}
+	for _, domain := range domains {
+		for _, p := range domain.Paths {
+			if p.Cfg == nil || !p.Cfg.Synced() {
+				continue
+			}
+			key := domain.Name + " " + p.Path
+			source := cfgSource(p.Cfg)
+			wanted[key] = true
+			if loop, ok := d.loops[key]; ok {
+				if loop.source == source {
+					continue
+				}
+				loop.cancel()
+			}
+
+			loopCtx, cancel := context.WithCancel(ctx)
+			d.loops[key] = &discoveryLoop{source: source, cancel: cancel}
+			d.wg.Add(1)
+			go func(name, path string, cfg *types.DomainCfg) {
+				defer d.wg.Done()
+				if cfg.Service != nil {
+					d.watchService(loopCtx, name, path, source, cfg.Service)
+				} else {
+					d.watchDNS(loopCtx, name, path, source, cfg.DNS)
+				}
+			}(domain.Name, p.Path, p.Cfg)
+		}
+	}
+	for key, loop := range d.loops {
+		if !wanted[key] {
+			loop.cancel()
+			delete(d.loops, key)
+		}
+	}
+}
+
+func jsonOf(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func hasTags(list, tags []string) bool {
+	for _, tag := range tags {
+		if !contains(list, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// serviceServers returns the host:port of the entries which have all the
+// tags, sorted. An instance without an address of its own is reached at the
+// address of its node.
+func serviceServers(entries []*api.ServiceEntry, tags []string) []string {
+	servers := []string{}
+	for _, e := range entries {
+		if !hasTags(e.Service.Tags, tags) {
+			continue
+		}
+		addr := e.Service.Address
+		if addr == "" && e.Node != nil {
+			addr = e.Node.Address
+		}
+		servers = append(servers, net.JoinHostPort(addr, strconv.Itoa(e.Service.Port)))
+	}
+	sort.Strings(servers)
+	return servers
+}
+
+// watchService follows the passing instances of the service of a domain path
+// with consul blocking queries until ctx is cancelled. The servers are left as
+// they are while no instance passes, unless the source allows an empty path.
+func (d *discovery) watchService(ctx context.Context, domain, path, source string, src *types.ServiceSource) {
+	log := logrus.WithFields(logrus.Fields{"domain": domain, "path": path, "service": src.Name})
+	log.Info("discovery: syncing servers from consul")
+
+	var tag string
+	if len(src.Tags) > 0 {
+		tag = src.Tags[0]
+	}
+	var index uint64
+	backoff := time.Second
+	for {
+		entries, meta, err := d.client.Health().Service(src.Name, tag, true, &api.QueryOptions{
+			Datacenter: src.Datacenter,
+			WaitIndex:  index,
+			WaitTime:   5 * time.Minute,
+			Context:    ctx,
+		})
+		if err == nil {
+			// consul may reset its index, e.g. after a snapshot restore
+			if meta.LastIndex < index {
+				meta.LastIndex = 0
+			}
+			if meta.LastIndex == index && index != 0 {
+				continue
+			}
+			servers := serviceServers(entries, src.Tags)
+			if len(servers) == 0 && !src.AllowEmpty {
+				// as for dns, an outage of the service does not empty
+				// the path
+				log.Warn("discovery: no passing instance, keeping the last servers")
+				index = meta.LastIndex
+				continue
+			}
+			if err = d.sync(ctx, domain, path, source, servers); err == nil {
+				index = meta.LastIndex
+				backoff = time.Second
+				continue
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Warnf("discovery: sync fail :%s", err.Error())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// sync makes servers the servers of the domain path, the keys of the other
+// servers of the path are deleted. Nothing is written when the cfg of the
+// path no longer has source, e.g. the domain was just removed and the loop is
+// about to be stopped.
+func (d *discovery) sync(ctx context.Context, domain, path, source string, servers []string) error {
+	cfg, _, err := d.client.KV().Get(cfgKey(domain, path), &api.QueryOptions{RequireConsistent: true, Context: ctx})
+	if err != nil {
+		return err
+	}
+	current := &types.DomainCfg{}
+	if cfg == nil || json.Unmarshal(cfg.Value, current) != nil || cfgSource(current) != source {
+		return nil
+	}
+
+	prefix := fmt.Sprintf("%s%s/server/%s/", zlbPrefix, domain, encodePath(path))
+	pairs, _, err := d.client.KV().List(prefix, &api.QueryOptions{RequireConsistent: true, Context: ctx})
+	if err != nil {
+		return err
+	}
+	desired := map[string]string{}
+	for _, s := range servers {
+		desired[serverKey(domain, path, s)] = ""
+	}
+	changes := planChanges(pairs, desired, func(key string) bool { return key != prefix })
+	if len(changes) == 0 || ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err := applyChanges(ctx, d.client, changes); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"domain": domain, "path": path, "servers": len(servers), "changes": len(changes)}).Info("discovery: servers synced")
+	return nil
+}
+
+// watchDNS resolves the dns name of a domain path whenever its records
+// expire, until ctx is cancelled. The servers are left as they are when the
+// name cannot be resolved or has no records, so that a dns outage does not
+// empty the path.
+func (d *discovery) watchDNS(ctx context.Context, domain, path, source string, src *types.DNSSource) {
+	log := logrus.WithFields(logrus.Fields{"domain": domain, "path": path, "dns": src.Name})
+	log.Info("discovery: syncing servers from dns")
+
+	backoff := dnsMinInterval
+	for {
+		servers, ttl, err := resolveServers(ctx, d.resolver, src.Name, src.Type, src.Port)
+		if err == nil && len(servers) == 0 {
+			err = fmt.Errorf("%s has no records", src.Name)
+		}
+		if err == nil {
+			err = d.sync(ctx, domain, path, source, servers)
+		}
+
+		wait := time.Duration(ttl) * time.Second
+		if wait < dnsMinInterval {
+			wait = dnsMinInterval
+		} else if wait > dnsMaxInterval {
+			wait = dnsMaxInterval
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Warnf("discovery: sync fail, keeping the last servers :%s", err.Error())
+			wait = backoff
+			if backoff < dnsMaxInterval {
+				backoff *= 2
+			}
+		} else {
+			backoff = dnsMinInterval
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+
+	dnsTimeout = 5 * time.Second
+)
+
+// dnsRecord is an address or a service record of an answer, Port is only set
+// for service records.
+type dnsRecord struct {
+	Host     string
+	Port     int
+	Priority int
+	TTL      uint32
+}
+
+type dnsError struct {
+	name  string
+	rcode int
+}
+
+func (e *dnsError) Error() string {
+	switch e.rcode {
+	case 2:
+		return fmt.Sprintf("lookup %s: server failure", e.name)
+	case 3:
+		return fmt.Sprintf("lookup %s: no such host", e.name)
+	case 5:
+		return fmt.Sprintf("lookup %s: refused", e.name)
+	}
+	return fmt.Sprintf("lookup %s: rcode %d", e.name, e.rcode)
+}
+
+// systemResolver returns the first nameserver of /etc/resolv.conf.
+func systemResolver() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// dnsQuery returns a recursive query for name, it is a fully qualified name
+// with or without the trailing dot.
+func dnsQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0100) // recursion desired
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return nil, fmt.Errorf("invalid dns name %q", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), 0, 1)
+	return msg, nil
+}
+
+var errDNSMessage = errors.New("malformed dns message")
+
+// readName reads the possibly compressed name at off, it returns the name and
+// the offset after it.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSMessage
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 16 {
+				return "", 0, errDNSMessage
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errDNSMessage
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+// parseAnswer returns the records of qtype of the answer section, whatever
+// their owner name since a resolver puts the records of a CNAME target
+// there too.
+func parseAnswer(msg []byte, id uint16, name string, qtype uint16) (answers []dnsRecord, err error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg) != id || msg[2]&0x80 == 0 {
+		return nil, errDNSMessage
+	}
+	if rcode := int(msg[3] & 0x0f); rcode != 0 {
+		return nil, &dnsError{name: name, rcode: rcode}
+	}
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	an := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := 12
+	for i := 0; i < qd; i++ {
+		if _, off, err = readName(msg, off); err != nil {
+			return nil, err
+		}
+		off += 4
+	}
+	for i := 0; i < an; i++ {
+		if _, off, err = readName(msg, off); err != nil {
+			return nil, err
+		}
+		if off+10 > len(msg) {
+			return nil, errDNSMessage
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		ttl := binary.BigEndian.Uint32(msg[off+4:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		rdata := off + 10
+		if off = rdata + rdlen; off > len(msg) {
+			return nil, errDNSMessage
+		}
+
+		var rec *dnsRecord
+		switch {
+		case rtype == dnsTypeA && rdlen == 4, rtype == dnsTypeAAAA && rdlen == 16:
+			rec = &dnsRecord{Host: net.IP(msg[rdata:off]).String(), TTL: ttl}
+		case rtype == dnsTypeSRV && rdlen > 6:
+			target, _, err := readName(msg, rdata+6)
+			if err != nil {
+				return nil, err
+			}
+			rec = &dnsRecord{
+				Host:     target,
+				Port:     int(binary.BigEndian.Uint16(msg[rdata+4:])),
+				Priority: int(binary.BigEndian.Uint16(msg[rdata:])),
+				TTL:      ttl,
+			}
+		}
+		if rec != nil && rtype == qtype {
+			answers = append(answers, *rec)
+		}
+	}
+	return answers, nil
+}
+
+// dnsExchange sends the query over udp, and again over tcp when the answer is
+// truncated. The exchange gives up after dnsTimeout, or once ctx is done.
+func dnsExchange(ctx context.Context, resolver string, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+
+	msg, err := dnsRoundTrip(ctx, "udp", resolver, query)
+	if err != nil || len(msg) < 3 || msg[2]&0x02 == 0 {
+		return msg, err
+	}
+	return dnsRoundTrip(ctx, "tcp", resolver, query)
+}
+
+func dnsRoundTrip(ctx context.Context, network, resolver string, query []byte) (msg []byte, err error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, resolver)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	// a cancel interrupts the exchange as the deadline does
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}()
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	framed := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	copy(framed[2:], query)
+	if _, err := conn.Write(framed); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	msg = make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func dnsLookup(ctx context.Context, resolver, name string, qtype uint16) ([]dnsRecord, error) {
+	var b [2]byte
+	rand.Read(b[:])
+	id := binary.BigEndian.Uint16(b[:])
+	query, err := dnsQuery(id, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := dnsExchange(ctx, resolver, query)
+	if err != nil {
+		return nil, err
+	}
+	return parseAnswer(msg, id, name, qtype)
+}
+
+// resolveAddrs returns the A and AAAA records of name.
+func resolveAddrs(ctx context.Context, resolver, name string) ([]dnsRecord, error) {
+	var records []dnsRecord
+	var errs []string
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		answers, err := dnsLookup(ctx, resolver, name, qtype)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		records = append(records, answers...)
+	}
+	if len(errs) == 2 {
+		return nil, errors.New(errs[0])
+	}
+	return records, nil
+}
+
+// resolveServers returns the host:port of the servers of name, sorted, and
+// the smallest TTL of the records they come from. The servers of an A name
+// are its addresses with port. The servers of an SRV name are the addresses
+// of the targets of its records with the lowest priority, the others being
+// backups.
+func resolveServers(ctx context.Context, resolver, name, qtype string, port int) ([]string, uint32, error) {
+	ttl := uint32(0)
+	minTTL := func(records []dnsRecord) {
+		for _, r := range records {
+			if ttl == 0 || r.TTL < ttl {
+				ttl = r.TTL
+			}
+		}
+	}
+	seen := map[string]bool{}
+	var servers []string
+	add := func(host string, port int) {
+		s := net.JoinHostPort(host, strconv.Itoa(port))
+		if !seen[s] {
+			seen[s] = true
+			servers = append(servers, s)
+		}
+	}
+
+	if qtype != "SRV" {
+		records, err := resolveAddrs(ctx, resolver, name)
+		if err != nil {
+			return nil, 0, err
+		}
+		minTTL(records)
+		for _, r := range records {
+			add(r.Host, port)
+		}
+		sort.Strings(servers)
+		return servers, ttl, nil
+	}
+
+	answers, err := dnsLookup(ctx, resolver, name, dnsTypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+	priority := -1
+	for _, r := range answers {
+		if priority < 0 || r.Priority < priority {
+			priority = r.Priority
+		}
+	}
+	for _, r := range answers {
+		if r.Priority != priority || r.Host == "" {
+			continue
+		}
+		minTTL([]dnsRecord{r})
+		if ip := net.ParseIP(r.Host); ip != nil {
+			add(ip.String(), r.Port)
+			continue
+		}
+		addrs, err := resolveAddrs(ctx, resolver, r.Host)
+		if err != nil {
+			return nil, 0, err
+		}
+		minTTL(addrs)
+		for _, a := range addrs {
+			add(a.Host, r.Port)
+		}
+	}
+	sort.Strings(servers)
+	return servers, ttl, nil
+}
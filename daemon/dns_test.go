@@ -0,0 +1,278 @@
+package daemon
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testRR struct {
+	name  string
+	rtype uint16
+	ttl   uint32
+	rdata []byte
+}
+
+func dnsName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func aRR(name, ip string, ttl uint32) testRR {
+	return testRR{name, dnsTypeA, ttl, net.ParseIP(ip).To4()}
+}
+
+func srvRR(name string, priority, port int, target string, ttl uint32) testRR {
+	rdata := make([]byte, 6)
+	binary.BigEndian.PutUint16(rdata, uint16(priority))
+	binary.BigEndian.PutUint16(rdata[4:], uint16(port))
+	return testRR{name, dnsTypeSRV, ttl, append(rdata, dnsName(target)...)}
+}
+
+// dnsAnswer returns the answer with rcode and rrs to query, the names of
+// the records are not compressed.
+func dnsAnswer(query []byte, flags uint16, rcode int, rrs []testRR) []byte {
+	_, end, _ := readName(query, 12)
+	msg := make([]byte, 12, 512)
+	copy(msg, query[:2])
+	binary.BigEndian.PutUint16(msg[2:], 0x8180|flags|uint16(rcode))
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(rrs)))
+	msg = append(msg, query[12:end+4]...)
+	for _, rr := range rrs {
+		msg = append(msg, dnsName(rr.name)...)
+		var fixed [10]byte
+		binary.BigEndian.PutUint16(fixed[0:], rr.rtype)
+		binary.BigEndian.PutUint16(fixed[2:], 1)
+		binary.BigEndian.PutUint32(fixed[4:], rr.ttl)
+		binary.BigEndian.PutUint16(fixed[8:], uint16(len(rr.rdata)))
+		msg = append(msg, fixed[:]...)
+		msg = append(msg, rr.rdata...)
+	}
+	return msg
+}
+
+// fakeDNS answers the queries over udp and tcp on the same port from its
+// records, keyed by name and type. The names it has no record for do not
+// exist. With truncate, the answers over udp have the TC bit and no record.
+type fakeDNS struct {
+	records  map[string][]testRR
+	truncate bool
+	silent   bool
+
+	addr string
+	udp  net.PacketConn
+	tcp  net.Listener
+}
+
+func startFakeDNS(t *testing.T, f *fakeDNS) *fakeDNS {
+	for i := 0; ; i++ {
+		udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+		if err != nil {
+			udp.Close()
+			if i < 10 {
+				continue
+			}
+			t.Fatal(err)
+		}
+		f.udp, f.tcp, f.addr = udp, tcp, udp.LocalAddr().String()
+		break
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := f.udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if !f.silent {
+				f.udp.WriteTo(f.answer(buf[:n], f.truncate), addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := f.tcp.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				msg := f.answer(query, false)
+				binary.BigEndian.PutUint16(length[:], uint16(len(msg)))
+				conn.Write(append(length[:], msg...))
+			}()
+		}
+	}()
+	return f
+}
+
+func (f *fakeDNS) Close() {
+	f.udp.Close()
+	f.tcp.Close()
+}
+
+func (f *fakeDNS) answer(query []byte, truncate bool) []byte {
+	name, end, err := readName(query, 12)
+	if err != nil {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[end:])
+	if truncate {
+		return dnsAnswer(query, 0x0200, 0, nil)
+	}
+	exists := false
+	var rrs []testRR
+	for _, rr := range f.records[name] {
+		exists = true
+		if rr.rtype == qtype {
+			rrs = append(rrs, rr)
+		}
+	}
+	if !exists {
+		return dnsAnswer(query, 0, 3, nil)
+	}
+	return dnsAnswer(query, 0, 0, rrs)
+}
+
+func TestParseAnswerCompression(t *testing.T) {
+	query, _ := dnsQuery(7, "_http._tcp.svc.test", dnsTypeSRV)
+	msg := dnsAnswer(query, 0, 0, nil)
+	binary.BigEndian.PutUint16(msg[6:], 2)
+	// the owner of both records is a pointer to the question, the target of
+	// the first is a label followed by a pointer to svc.test of the question
+	// and the target of the second a pointer to the target of the first
+	rr := func(rdata []byte) {
+		msg = append(msg, 0xc0, 12, 0, dnsTypeSRV, 0, 1, 0, 0, 0, 60, 0, byte(len(rdata)))
+		msg = append(msg, rdata...)
+	}
+	target := len(msg) + 12 + 6
+	rr([]byte{0, 1, 0, 0, 0x1f, 0x90, 2, 'n', '1', 0xc0, 12 + 1 + 5 + 1 + 4})
+	rr([]byte{0, 1, 0, 0, 0x1f, 0x91, 0xc0, byte(target)})
+
+	answers, err := parseAnswer(msg, 7, "_http._tcp.svc.test", dnsTypeSRV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []dnsRecord{
+		{Host: "n1.svc.test", Port: 8080, Priority: 1, TTL: 60},
+		{Host: "n1.svc.test", Port: 8081, Priority: 1, TTL: 60},
+	}
+	if !reflect.DeepEqual(answers, want) {
+		t.Errorf("got %+v, want %+v", answers, want)
+	}
+}
+
+func TestParseAnswerMalformed(t *testing.T) {
+	query, _ := dnsQuery(7, "a.test", dnsTypeA)
+	valid := dnsAnswer(query, 0, 0, []testRR{aRR("a.test", "10.0.0.1", 60)})
+
+	loop := dnsAnswer(query, 0, 0, nil)
+	binary.BigEndian.PutUint16(loop[6:], 1)
+	loop = append(loop, 0xc0, byte(len(loop)), 0, dnsTypeA, 0, 1, 0, 0, 0, 60, 0, 4, 10, 0, 0, 1)
+
+	for name, msg := range map[string][]byte{
+		"short header":    valid[:8],
+		"truncated rdata": valid[:len(valid)-2],
+		"truncated name":  valid[:len(query)+3],
+		"pointer loop":    loop,
+		"wrong id":        dnsAnswer(append([]byte{0, 8}, query[2:]...), 0, 0, nil),
+	} {
+		if _, err := parseAnswer(msg, 7, "a.test", dnsTypeA); err != errDNSMessage {
+			t.Errorf("%s: got error %v, want %v", name, err, errDNSMessage)
+		}
+	}
+}
+
+func TestDNSLookupNXDomain(t *testing.T) {
+	f := startFakeDNS(t, &fakeDNS{})
+	defer f.Close()
+
+	_, err := dnsLookup(context.Background(), f.addr, "missing.test", dnsTypeA)
+	if e, ok := err.(*dnsError); !ok || e.rcode != 3 {
+		t.Fatalf("got error %v, want no such host", err)
+	}
+	if _, _, err := resolveServers(context.Background(), f.addr, "missing.test", "A", 80); err == nil || !strings.Contains(err.Error(), "no such host") {
+		t.Errorf("got error %v, want no such host", err)
+	}
+}
+
+func TestDNSLookupTruncated(t *testing.T) {
+	f := startFakeDNS(t, &fakeDNS{
+		truncate: true,
+		records: map[string][]testRR{
+			"a.test": {aRR("a.test", "10.0.0.1", 60), aRR("a.test", "10.0.0.2", 30)},
+		},
+	})
+	defer f.Close()
+
+	servers, ttl, err := resolveServers(context.Background(), f.addr, "a.test", "A", 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.1:80", "10.0.0.2:80"}; !reflect.DeepEqual(servers, want) || ttl != 30 {
+		t.Errorf("got %v ttl %d, want %v ttl 30", servers, ttl, want)
+	}
+}
+
+func TestResolveServersSRVPriority(t *testing.T) {
+	name := "_http._tcp.svc.test"
+	f := startFakeDNS(t, &fakeDNS{
+		records: map[string][]testRR{
+			name: {
+				srvRR(name, 20, 9000, "backup.svc.test", 60),
+				srvRR(name, 10, 8080, "n1.svc.test", 120),
+				srvRR(name, 10, 8081, "n2.svc.test", 120),
+			},
+			"n1.svc.test":     {aRR("n1.svc.test", "10.0.0.1", 90)},
+			"n2.svc.test":     {aRR("n2.svc.test", "10.0.0.2", 300)},
+			"backup.svc.test": {aRR("backup.svc.test", "10.0.0.9", 5)},
+		},
+	})
+	defer f.Close()
+
+	servers, ttl, err := resolveServers(context.Background(), f.addr, name, "SRV", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.1:8080", "10.0.0.2:8081"}; !reflect.DeepEqual(servers, want) || ttl != 90 {
+		t.Errorf("got %v ttl %d, want %v ttl 90", servers, ttl, want)
+	}
+}
+
+func TestDNSExchangeCancel(t *testing.T) {
+	f := startFakeDNS(t, &fakeDNS{silent: true})
+	defer f.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := dnsLookup(ctx, f.addr, "a.test", dnsTypeA)
+	if err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the lookup returned after %s, not once cancelled", elapsed)
+	}
+}
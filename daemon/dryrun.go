@@ -0,0 +1,69 @@
+package daemon
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/zanecloud/zlb/api/types"
+)
+
+func isDryRun(r *http.Request) bool {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	return dryRun
+}
+
+// planRequest lists what a mutating request does to consul: a write of every
+// key of set, even when its value does not change, and a delete of every
+// existing key of del. Keys of del which end with a slash delete a tree.
+func planRequest(client *api.Client, set map[string]string, del []string) ([]*types.KVChange, error) {
+	var changes []*types.KVChange
+	for k, v := range set {
+		pair, _, err := client.KV().Get(k, &api.QueryOptions{RequireConsistent: true})
+		if err != nil {
+			return nil, err
+		}
+		c := &types.KVChange{Op: "set", Key: k, New: v}
+		if pair != nil {
+			c.Old = string(pair.Value)
+			c.Index = pair.ModifyIndex
+		}
+		changes = append(changes, c)
+	}
+	for _, k := range del {
+		var pairs api.KVPairs
+		if strings.HasSuffix(k, "/") {
+			list, _, err := client.KV().List(k, &api.QueryOptions{RequireConsistent: true})
+			if err != nil {
+				return nil, err
+			}
+			pairs = list
+		} else {
+			pair, _, err := client.KV().Get(k, &api.QueryOptions{RequireConsistent: true})
+			if err != nil {
+				return nil, err
+			}
+			if pair != nil {
+				pairs = append(pairs, pair)
+			}
+		}
+		for _, pair := range pairs {
+			changes = append(changes, &types.KVChange{Op: "delete", Key: pair.Key, Old: string(pair.Value), Index: pair.ModifyIndex})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes, nil
+}
+
+// writeDryRun answers a ?dry_run=true request with its plan instead of
+// changing consul.
+func writeDryRun(w http.ResponseWriter, client *api.Client, set map[string]string, del []string) {
+	changes, err := planRequest(client, set, del)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, &types.ApplyReport{Changes: changes, DryRun: true})
+}
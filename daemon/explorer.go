@@ -0,0 +1,153 @@
+package daemon
+
+import (
+	"context"
+	"net/http"
+)
+
+const explorerPath = "/docs"
+
+func getExplorer(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(explorerPage))
+}
+
+// explorerPage lists the operations of the OpenAPI document and sends
+// requests to them, it has no dependency so that it works offline.
+const explorerPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>zlb api</title>
+<style>
+body { font-family: sans-serif; margin: 0 auto; max-width: 1000px; padding: 1em; color: #222; }
+h1 small { color: #888; font-size: 50%; }
+h2 { border-bottom: 1px solid #ddd; text-transform: capitalize; }
+details { border: 1px solid #ddd; border-radius: 4px; margin: .4em 0; }
+summary { cursor: pointer; padding: .5em; }
+summary .method { background: #49cc90; border-radius: 3px; color: #fff; display: inline-block; font-weight: bold; margin-right: .5em; min-width: 4em; text-align: center; }
+summary .method.get { background: #61affe; }
+summary code { font-weight: bold; }
+summary span.summary { color: #555; margin-left: 1em; }
+.op { padding: 0 1em 1em; }
+label { display: block; margin: .3em 0; }
+label span { display: inline-block; width: 10em; }
+input[type=text] { width: 20em; }
+textarea { font-family: monospace; height: 10em; width: 100%; }
+pre { background: #f6f6f6; overflow: auto; padding: .5em; }
+#auth { margin-bottom: 1em; }
+</style>
+</head>
+<body>
+<h1>zlb api <small id="version"></small></h1>
+<div id="auth"><label><span>Bearer token</span><input type="text" id="token"></label></div>
+<div id="ops">loading...</div>
+<script>
+var spec;
+
+function schemaOf(s) {
+  if (!s) return null;
+  if (s.$ref) return schemaOf(spec.components.schemas[s.$ref.split("/").pop()]);
+  return s;
+}
+
+// example builds a sample value of a schema to fill the request body.
+function example(s, depth) {
+  s = schemaOf(s);
+  if (!s || depth > 4) return null;
+  switch (s.type) {
+  case "object":
+    var o = {};
+    for (var k in s.properties || {}) o[k] = example(s.properties[k], depth + 1);
+    return o;
+  case "array": return [example(s.items, depth + 1)];
+  case "integer": case "number": return 0;
+  case "boolean": return false;
+  case "string": return s.enum ? s.enum[0] : "";
+  }
+  return null;
+}
+
+function el(tag, attrs, children) {
+  var e = document.createElement(tag);
+  for (var k in attrs || {}) e.setAttribute(k, attrs[k]);
+  (children || []).forEach(function (c) {
+    e.appendChild(typeof c === "string" ? document.createTextNode(c) : c);
+  });
+  return e;
+}
+
+function operation(path, method, op) {
+  var inputs = {}, body = null, result = el("pre");
+  var form = el("div", {"class": "op"});
+  (op.parameters || []).forEach(function (p) {
+    inputs[p.name] = el("input", {type: "text", placeholder: p.description || ""});
+    inputs[p.name].param = p;
+    form.appendChild(el("label", {}, [el("span", {}, [p.name + " (" + p.in + ")" + (p.required ? " *" : "")]), inputs[p.name]]));
+  });
+  if (op.requestBody) {
+    var content = op.requestBody.content, type = Object.keys(content)[0];
+    body = el("textarea");
+    body.contentType = type;
+    var ex = example(content[type].schema, 0);
+    body.value = typeof ex === "string" ? ex : JSON.stringify(ex, null, 2);
+    form.appendChild(el("label", {}, [el("span", {}, ["body (" + type + ")"])]));
+    form.appendChild(body);
+  }
+  var send = el("button", {}, ["Send"]);
+  send.onclick = function () {
+    var url = path, query = [];
+    for (var name in inputs) {
+      var v = inputs[name].value;
+      if (inputs[name].param.in === "path") url = url.replace("{" + name + "}", encodeURIComponent(v));
+      else if (v !== "") query.push(encodeURIComponent(name) + "=" + encodeURIComponent(v));
+    }
+    if (query.length) url += "?" + query.join("&");
+    var headers = {};
+    var token = document.getElementById("token").value;
+    if (token) headers["Authorization"] = "Bearer " + token;
+    if (body) headers["Content-Type"] = body.contentType;
+    result.textContent = method.toUpperCase() + " " + url + "\n...";
+    fetch(url, {method: method.toUpperCase(), headers: headers, body: body ? body.value : undefined})
+      .then(function (resp) {
+        return resp.text().then(function (text) {
+          try { text = JSON.stringify(JSON.parse(text), null, 2); } catch (e) {}
+          result.textContent = resp.status + " " + resp.statusText + "\n\n" + text;
+        });
+      })
+      .catch(function (e) { result.textContent = String(e); });
+  };
+  form.appendChild(send);
+  form.appendChild(result);
+  return el("details", {}, [
+    el("summary", {}, [el("span", {"class": "method " + method}, [method.toUpperCase()]), el("code", {}, [path]), el("span", {"class": "summary"}, [op.summary || ""])]),
+    form
+  ]);
+}
+
+fetch("` + openAPIPath + `").then(function (r) { return r.json(); }).then(function (s) {
+  spec = s;
+  document.getElementById("version").textContent = s.info.version;
+  var token = document.getElementById("token");
+  token.value = localStorage.getItem("zlb-token") || "";
+  token.onchange = function () { localStorage.setItem("zlb-token", token.value); };
+
+  var tags = {};
+  Object.keys(s.paths).sort().forEach(function (path) {
+    for (var method in s.paths[path]) {
+      var op = s.paths[path][method], tag = (op.tags || ["other"])[0];
+      (tags[tag] = tags[tag] || []).push(operation(path, method, op));
+    }
+  });
+  var ops = document.getElementById("ops");
+  ops.textContent = "";
+  Object.keys(tags).forEach(function (tag) {
+    ops.appendChild(el("h2", {}, [tag]));
+    tags[tag].forEach(function (e) { ops.appendChild(e); });
+  });
+});
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,176 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strings"
+
+	"github.com/zanecloud/zlb/api/types"
+)
+
+// RenderHaproxy writes a single http frontend routing on host and path
+// prefix, and one backend per domain path. Http and https health checks
+// become httpchk with the expected statuses, redis, mysql and exec checks the
+// checks of haproxy for them, passive checks observe the traffic, sticky paths
+// get an inserted cookie.
+func RenderHaproxy(w io.Writer, domains []*types.Domain) error {
+	var frontend, backends bytes.Buffer
+
+	fmt.Fprintf(&frontend, "frontend zlb_http\n    bind *:80\n    mode http\n")
+	for _, d := range domains {
+		host := "host_" + strings.TrimPrefix(upstreamName(d.Name, ""), "zlb_")
+		fmt.Fprintf(&frontend, "\n    acl %s hdr(host),field(1,:) -i %s\n", host, d.Name)
+		for _, p := range d.SortedPaths() {
+			name := upstreamName(d.Name, p.Path)
+			// the paths written before they were validated are not rendered
+			if err := types.ValidatePath(p.Path); err != nil {
+				fmt.Fprintf(&frontend, "    # %s: skipped, invalid path (%s)\n", name, err.Error())
+				continue
+			}
+			if len(p.Servers) == 0 {
+				fmt.Fprintf(&frontend, "    # %s%s has no servers\n", d.Name, p.Path)
+				continue
+			}
+			if p.Path == "/" {
+				fmt.Fprintf(&frontend, "    use_backend %s if %s\n", name, host)
+			} else {
+				fmt.Fprintf(&frontend, "    use_backend %s if %s { path_beg %s }\n", name, host, p.Path)
+			}
+			renderHaproxyBackend(&backends, d.Name, name, p)
+		}
+	}
+
+	if _, err := frontend.WriteTo(w); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\n")
+	_, err := backends.WriteTo(w)
+	return err
+}
+
+// haproxyServerID returns the name of server s in its backend. The names of
+// the servers which differ only by their punctuation are told apart by a
+// hash of the server.
+func haproxyServerID(s string) string {
+	h := fnv.New32a()
+	io.WriteString(h, s)
+	return fmt.Sprintf("%s_%08x", strings.Trim(nonWord.ReplaceAllString(s, "_"), "_"), h.Sum32())
+}
+
+// haproxyBalance returns the balance algorithm of b.
+func haproxyBalance(b *types.BalancerCfg) string {
+	if b == nil {
+		return "roundrobin"
+	}
+	switch b.Algorithm {
+	case "least_conn":
+		return "leastconn"
+	case "random_two":
+		return "random(2)"
+	case "hash":
+		switch b.Hash_on {
+		case "header":
+			return fmt.Sprintf("hdr(%s)", b.Hash_key)
+		case "cookie":
+			return fmt.Sprintf("hash req.cook(%s)", b.Hash_key)
+		case "uri":
+			return "uri"
+		}
+	}
+	return "roundrobin"
+}
+
+func renderHaproxyBackend(w *bytes.Buffer, domain, name string, p *types.DomainPath) {
+	cfg := pathCfg(p)
+	hc := &cfg.Healthcheck
+
+	fmt.Fprintf(w, "backend %s\n    mode http\n    balance %s\n", name, haproxyBalance(cfg.Balancer))
+	if b := cfg.Balancer; b != nil && b.Algorithm == "hash" {
+		fmt.Fprintf(w, "    hash-type consistent\n")
+	}
+	if cfg.Sticky {
+		fmt.Fprintf(w, "    cookie ZLBSERVERID insert indirect nocache\n")
+	}
+	check := ""
+	if hc.Type != "" {
+		check = " check"
+		switch hc.Type {
+		case "http", "https":
+			uri := hc.Uri
+			if uri == "" {
+				uri = "/"
+			}
+			if err := types.ValidatePath(uri); err != nil {
+				fmt.Fprintf(w, "    # invalid Uri (%s), the servers are checked with a tcp connect\n", err.Error())
+				break
+			}
+			fmt.Fprintf(w, "    option httpchk GET %s HTTP/1.1\\r\\nHost:\\ %s\n", uri, domain)
+			if statuses := validStatuses(hc); len(statuses) > 0 {
+				fmt.Fprintf(w, "    http-check expect rstatus ^(%s)$\n", strings.Join(statuses, "|"))
+			}
+			if hc.Type == "https" {
+				sni := hc.Sni
+				if sni == "" {
+					sni = domain
+				}
+				check += " check-ssl check-sni " + sni
+				if hc.Skip_verify {
+					check += " verify none"
+				} else {
+					check += " ca-file @system-ca"
+				}
+			}
+		case "grpc":
+			fmt.Fprintf(w, "    # grpc checks are not supported, the servers are checked with a tcp connect\n")
+		case "redis":
+			fmt.Fprintf(w, "    option redis-check\n")
+		case "mysql":
+			if hc.Mysql_user != "" {
+				fmt.Fprintf(w, "    option mysql-check user %s post-41\n", hc.Mysql_user)
+			} else {
+				fmt.Fprintf(w, "    option mysql-check\n")
+			}
+		case "exec":
+			if err := types.ValidatePath(hc.Command); err != nil {
+				fmt.Fprintf(w, "    # invalid Command (%s), the servers are checked with a tcp connect\n", err.Error())
+				break
+			}
+			fmt.Fprintf(w, "    # external checks need external-check and insecure-fork-wanted in the global section\n")
+			fmt.Fprintf(w, "    option external-check\n    external-check command %s\n", hc.Command)
+		}
+		fmt.Fprintf(w, "    timeout check %dms\n", orDefault(hc.Timeout, defaultTimeout))
+		fmt.Fprintf(w, "    default-server inter %dms fall %d rise %d\n",
+			orDefault(hc.Interval, defaultInterval), orDefault(hc.Fall, defaultFall), orDefault(hc.Rise, defaultRise))
+	}
+	if pc := cfg.Passive; pc != nil {
+		// an ejected server is marked down, and checked again after the
+		// ejection time
+		if check == "" {
+			fmt.Fprintf(w, "    # passive checks need check, the servers are checked with a tcp connect\n")
+			check = " check"
+		}
+		if pc.Max_ejection_percent > 0 {
+			fmt.Fprintf(w, "    # Max_ejection_percent is not supported by haproxy\n")
+		}
+		layer := "layer4"
+		if pc.Consecutive_5xx > 0 {
+			layer = "layer7"
+		}
+		check += fmt.Sprintf(" observe %s error-limit %d on-error mark-down downinter %dms",
+			layer, passiveThreshold(pc), orDefault(pc.Ejection_time, defaultEjectionTime))
+	}
+	for _, s := range p.Servers {
+		id := haproxyServerID(s)
+		fmt.Fprintf(w, "    server %s %s%s", id, s, check)
+		if weight := serverWeight(cfg.Balancer, s); weight > 0 {
+			fmt.Fprintf(w, " weight %d", weight)
+		}
+		if cfg.Sticky {
+			fmt.Fprintf(w, " cookie %s", id)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	fmt.Fprintf(w, "\n")
+}
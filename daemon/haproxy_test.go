@@ -0,0 +1,98 @@
+package daemon
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/zanecloud/zlb/api/types"
+)
+
+func renderHaproxy(t *testing.T, d *types.Domain) string {
+	var buf bytes.Buffer
+	if err := RenderHaproxy(&buf, []*types.Domain{d}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestRenderHaproxy(t *testing.T) {
+	d := &types.Domain{Name: "www.test.com"}
+	root := d.EnsurePath("/")
+	root.Servers = []string{"10.0.0.1:80"}
+	api := d.EnsurePath("/api")
+	api.Servers = []string{"10.0.0.2:8080"}
+	api.Cfg = &types.DomainCfg{
+		Path:        "/api",
+		Sticky:      true,
+		Healthcheck: types.HealthCheckCfg{Type: "http", Uri: "/health", Valid_statuses: "200,204"},
+	}
+
+	out := renderHaproxy(t, d)
+	rootName, apiName := upstreamName(d.Name, "/"), upstreamName(d.Name, "/api")
+	id := haproxyServerID("10.0.0.2:8080")
+	for _, want := range []string{
+		"    use_backend " + apiName + " if host_www_test_com_",
+		" { path_beg /api }\n",
+		"    use_backend " + rootName + " if host_www_test_com_",
+		"backend " + apiName + "\n    mode http\n    balance roundrobin\n    cookie ZLBSERVERID insert indirect nocache\n",
+		"    option httpchk GET /health HTTP/1.1\\r\\nHost:\\ www.test.com\n",
+		"    http-check expect rstatus ^(200|204)$\n",
+		"    server " + id + " 10.0.0.2:8080 check cookie " + id + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%s", want, out)
+		}
+	}
+	// the longest path is matched first
+	if strings.Index(out, "use_backend "+apiName) > strings.Index(out, "use_backend "+rootName) {
+		t.Errorf("/ is routed before /api:\n%s", out)
+	}
+}
+
+func TestRenderHaproxyServerIDs(t *testing.T) {
+	d := &types.Domain{Name: "www.test.com"}
+	d.EnsurePath("/").Servers = []string{"a-b:80", "a.b:80", "a_b:80"}
+
+	out := renderHaproxy(t, d)
+	ids := map[string]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		if fields := strings.Fields(line); len(fields) > 2 && fields[0] == "server" {
+			if ids[fields[1]] {
+				t.Errorf("duplicate server name %s in\n%s", fields[1], out)
+			}
+			ids[fields[1]] = true
+		}
+	}
+	if len(ids) != 3 {
+		t.Errorf("got %d servers, want 3 in\n%s", len(ids), out)
+	}
+}
+
+// the paths, uris and commands of the tree are rendered only when they are
+// valid, those written directly into consul are not.
+func TestRenderHaproxyUnsafe(t *testing.T) {
+	for _, p := range unsafePaths {
+		d := &types.Domain{Name: "www.test.com"}
+		d.EnsurePath(p).Servers = []string{"10.0.0.1:80"}
+		http := d.EnsurePath("/http")
+		http.Servers = []string{"10.0.0.2:80"}
+		http.Cfg = &types.DomainCfg{Path: "/http", Healthcheck: types.HealthCheckCfg{Type: "http", Uri: p}}
+		exec := d.EnsurePath("/exec")
+		exec.Servers = []string{"10.0.0.3:80"}
+		exec.Cfg = &types.DomainCfg{Path: "/exec", Healthcheck: types.HealthCheckCfg{Type: "exec", Command: p}}
+
+		out := renderHaproxy(t, d)
+		if strings.Contains(out, "path_beg "+p) || strings.Contains(out, "10.0.0.1:80") {
+			t.Errorf("the path %q is rendered:\n%s", p, out)
+		}
+		if strings.Contains(out, "httpchk") || strings.Contains(out, "external-check command") {
+			t.Errorf("the uri or command %q is rendered:\n%s", p, out)
+		}
+		for _, s := range []string{"10.0.0.2:80 check\n", "10.0.0.3:80 check\n"} {
+			if !strings.Contains(out, s) {
+				t.Errorf("the server %q is not checked with a tcp connect:\n%s", s, out)
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/zanecloud/zlb/api/opts"
+	"github.com/zanecloud/zlb/api/types"
+)
+
+// the status api of consul takes no query options, the readiness probe
+// uses a consul client whose requests time out after this long
+const readyTimeout = 2 * time.Second
+
+func getHealthz(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// newReadyClient returns the consul client of the readiness probe, of opts
+// with transport, whose requests give up after readyTimeout.
+func newReadyClient(opts opts.Options, transport http.RoundTripper) (*api.Client, error) {
+	return api.NewClient(&api.Config{
+		Address:    opts.Consul,
+		Token:      opts.ConsulToken,
+		HttpClient: &http.Client{Transport: transport, Timeout: readyTimeout},
+	})
+}
+
+// consulReady checks that consul answers and that its cluster has a leader.
+func consulReady(client *api.Client) (string, int, error) {
+	leader, err := client.Status().Leader()
+	if err != nil {
+		return "", 0, err
+	}
+	peers, err := client.Status().Peers()
+	if err != nil {
+		return "", 0, err
+	}
+	if leader == "" {
+		return "", len(peers), errors.New("consul has no leader")
+	}
+	return leader, len(peers), nil
+}
+
+func getReadyz(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	client, _ := ctx.Value(KEY_READY_CLIENT).(*api.Client)
+	ready := &types.Readiness{}
+	if cache, ok := ctx.Value(KEY_TREE_CACHE).(*treeWatcher); ok {
+		ready.CacheIndex, _ = cache.Index()
+	}
+
+	leader, peers, err := consulReady(client)
+	ready.Leader, ready.Peers = leader, peers
+	if err != nil {
+		ready.Error = err.Error()
+		jsonstr, _ := json.Marshal(ready)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write(jsonstr)
+		return
+	}
+	ready.Ready = true
+	writeJson(w, ready)
+}
+
+func getVersion(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	options, _ := ctx.Value(KEY_SERVER_OPTS).(opts.Options)
+	writeJson(w, &types.VersionInfo{
+		Version:   options.BuildVersion,
+		GitCommit: options.GitCommit,
+		BuildTime: options.BuildTime,
+		GoVersion: runtime.Version(),
+	})
+}
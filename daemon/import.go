@@ -0,0 +1,304 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/zanecloud/zlb/api/types"
+)
+
+type nginxUpstream struct {
+	servers []string
+	cfg     types.DomainCfg
+}
+
+// withPort appends the default port of scheme to addr if it has none.
+func withPort(addr, scheme string) string {
+	if strings.LastIndex(addr, ":") > strings.LastIndex(addr, "]") {
+		return addr
+	}
+	if scheme == "https" {
+		return addr + ":443"
+	}
+	return addr + ":80"
+}
+
+// nginxAliveStatuses returns the codes of a status class of
+// nginx_upstream_check_module, e.g. http_4xx, the lua checker wants codes.
+// The class is the codes of it which are registered.
+func nginxAliveStatuses(class string) ([]string, bool) {
+	if len(class) != 8 || !strings.HasPrefix(class, "http_") || !strings.HasSuffix(class, "xx") || class[5] < '2' || class[5] > '5' {
+		return nil, false
+	}
+	var codes []string
+	base := int(class[5]-'0') * 100
+	for code := base; code < base+100; code++ {
+		if http.StatusText(code) != "" {
+			codes = append(codes, strconv.Itoa(code))
+		}
+	}
+	return codes, true
+}
+
+// nginxHash returns the balancer of the key of an nginx hash directive, nil
+// when zlb has no hash on it.
+func nginxHash(key string) *types.BalancerCfg {
+	switch {
+	case key == "$request_uri" || key == "$uri":
+		return &types.BalancerCfg{Algorithm: "hash", Hash_on: "uri"}
+	case strings.HasPrefix(key, "$http_") && len(key) > 6:
+		// the variable of a header is its name lowercased with _ for -
+		return &types.BalancerCfg{Algorithm: "hash", Hash_on: "header", Hash_key: strings.Replace(key[6:], "_", "-", -1)}
+	case strings.HasPrefix(key, "$cookie_") && len(key) > 8:
+		return &types.BalancerCfg{Algorithm: "hash", Hash_on: "cookie", Hash_key: key[8:]}
+	}
+	return nil
+}
+
+func parseNginxUpstream(u *nginxDirective, warn func(string, ...interface{})) *nginxUpstream {
+	up := &nginxUpstream{}
+	weights := map[string]int{}
+	for _, d := range u.Block {
+		switch d.Name {
+		case "server":
+			if len(d.Args) == 0 {
+				continue
+			}
+			addr := d.Args[0]
+			if strings.HasPrefix(addr, "unix:") {
+				warn("line %d: unix socket server %s skipped", d.Line, addr)
+				continue
+			}
+			if contains(d.Args[1:], "down") {
+				continue
+			}
+			if contains(d.Args[1:], "backup") {
+				warn("line %d: backup server %s skipped", d.Line, addr)
+				continue
+			}
+			server := withPort(addr, "http")
+			up.servers = append(up.servers, server)
+			for _, arg := range d.Args[1:] {
+				if strings.HasPrefix(arg, "weight=") {
+					if weight, err := strconv.Atoi(arg[7:]); err == nil && weight != 1 {
+						weights[server] = weight
+					}
+				}
+			}
+		case "keepalive":
+			if len(d.Args) > 0 {
+				up.cfg.KeepAlive, _ = strconv.Atoi(d.Args[0])
+			}
+		case "ip_hash", "sticky":
+			up.cfg.Sticky = true
+		case "least_conn":
+			up.cfg.Balancer = &types.BalancerCfg{Algorithm: "least_conn"}
+		case "random":
+			if len(d.Args) > 0 && d.Args[0] == "two" {
+				up.cfg.Balancer = &types.BalancerCfg{Algorithm: "random_two"}
+			} else {
+				warn("line %d: random without two imported as round robin", d.Line)
+			}
+		case "hash":
+			if len(d.Args) == 0 {
+				continue
+			}
+			if b := nginxHash(d.Args[0]); b != nil {
+				up.cfg.Balancer = b
+			} else {
+				warn("line %d: hash %s imported as round robin, zlb hashes on a header, a cookie or the uri", d.Line, d.Args[0])
+			}
+		case "check":
+			hc := &up.cfg.Healthcheck
+			// the default type of nginx_upstream_check_module
+			hc.Type = "tcp"
+			for _, arg := range d.Args {
+				kv := strings.SplitN(arg, "=", 2)
+				if len(kv) != 2 {
+					continue
+				}
+				n, _ := strconv.Atoi(kv[1])
+				switch kv[0] {
+				case "type":
+					// the check types of nginx_upstream_check_module
+					// zlb has no check for
+					if kv[1] == "ssl_hello" || kv[1] == "ajp" {
+						warn("line %d: %s check imported as a tcp check", d.Line, kv[1])
+						kv[1] = "tcp"
+					}
+					hc.Type = kv[1]
+				case "interval":
+					hc.Interval = n
+				case "timeout":
+					hc.Timeout = n
+				case "fall":
+					hc.Fall = n
+				case "rise":
+					hc.Rise = n
+				}
+			}
+		case "check_http_send":
+			if len(d.Args) > 0 {
+				if f := strings.Fields(d.Args[0]); len(f) > 1 {
+					up.cfg.Healthcheck.Uri = f[1]
+				}
+			}
+		case "check_http_expect_alive":
+			var statuses []string
+			for _, arg := range d.Args {
+				codes, ok := nginxAliveStatuses(arg)
+				if !ok {
+					warn("line %d: check_http_expect_alive %s skipped", d.Line, arg)
+					continue
+				}
+				statuses = append(statuses, codes...)
+			}
+			up.cfg.Healthcheck.Valid_statuses = strings.Join(statuses, ",")
+		}
+	}
+	if len(weights) > 0 {
+		if up.cfg.Balancer == nil && !up.cfg.Sticky {
+			up.cfg.Balancer = &types.BalancerCfg{Algorithm: "weighted_round_robin", Weights: weights}
+		} else {
+			warn("line %d: the weights of upstream %s skipped, they only apply to round robin", u.Line, u.Args[0])
+		}
+	}
+	return up
+}
+
+// ImportNginx converts the server blocks of an nginx configuration into
+// domains, one path per prefix location proxying to an upstream or address.
+// Constructs which have no zlb equivalent are skipped and reported as warnings.
+func ImportNginx(conf []byte) ([]*types.Domain, []string, error) {
+	tree, err := parseNginx(string(conf))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var warnings []string
+	warn := func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+	for _, d := range findNginx(tree, "include") {
+		warn("line %d: include %s not followed", d.Line, strings.Join(d.Args, " "))
+	}
+
+	upstreams := map[string]*nginxUpstream{}
+	for _, u := range findNginx(tree, "upstream") {
+		if len(u.Args) == 1 && u.Block != nil {
+			upstreams[u.Args[0]] = parseNginxUpstream(u, warn)
+		}
+	}
+
+	domains := map[string]*types.Domain{}
+	var list []*types.Domain
+	for _, srv := range findNginx(tree, "server") {
+		if srv.Block == nil {
+			continue
+		}
+		var names []string
+		for _, sn := range findNginx(srv.Block, "server_name") {
+			for _, name := range sn.Args {
+				if name == "_" || name == "" || strings.ContainsAny(name, "~*$") {
+					warn("line %d: server_name %s skipped", sn.Line, name)
+					continue
+				}
+				names = append(names, strings.TrimPrefix(name, "."))
+			}
+		}
+		if len(names) == 0 {
+			warn("line %d: server without usable server_name skipped", srv.Line)
+			continue
+		}
+
+		for _, loc := range srv.Block {
+			if loc.Name != "location" || loc.Block == nil || len(loc.Args) == 0 {
+				continue
+			}
+			path := loc.Args[len(loc.Args)-1]
+			if len(loc.Args) > 1 && loc.Args[0] != "^~" {
+				warn("line %d: location %s skipped, only prefix locations are supported", loc.Line, strings.Join(loc.Args, " "))
+				continue
+			}
+			pp := firstNginx(loc.Block, "proxy_pass")
+			if pp == nil || len(pp.Args) == 0 {
+				continue
+			}
+			target := pp.Args[0]
+			if strings.Contains(target, "$") {
+				warn("line %d: proxy_pass %s skipped, variables are not supported", pp.Line, target)
+				continue
+			}
+			scheme := "http"
+			if i := strings.Index(target, "://"); i >= 0 {
+				scheme, target = target[:i], target[i+3:]
+			}
+			if i := strings.Index(target, "/"); i >= 0 {
+				target = target[:i]
+			}
+
+			up, ok := upstreams[target]
+			if !ok {
+				up = &nginxUpstream{servers: []string{withPort(target, scheme)}}
+			}
+			cfg := up.cfg
+			cfg.Path = path
+			if err := cfg.Validate(); err != nil {
+				warn("line %d: location %s skipped, %s", loc.Line, path, err.Error())
+				continue
+			}
+			for _, name := range names {
+				d, ok := domains[name]
+				if !ok {
+					d = &types.Domain{Name: name, Paths: map[string]*types.DomainPath{}}
+					domains[name] = d
+					list = append(list, d)
+				}
+				p := d.EnsurePath(path)
+				c := cfg
+				p.Cfg = &c
+				p.Servers = append([]string(nil), up.servers...)
+			}
+		}
+	}
+	return list, warnings, nil
+}
+
+// ImportDomains merges domains into the zlb/ tree, existing keys which are
+// not part of the import are kept. Nothing is written on a dry run.
+func ImportDomains(ctx context.Context, client *api.Client, domains []*types.Domain, dryRun bool) ([]*types.KVChange, error) {
+	changes, err := planDomains(client, domains, nil)
+	if err != nil || dryRun {
+		return changes, err
+	}
+	return changes, applyChanges(ctx, client, changes)
+}
+
+func importNginx(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	client, _ := ctx.Value(KEY_CONSUL_CLIENT).(*api.Client)
+	dryRun := isDryRun(r)
+
+	conf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	domains, warnings, err := ImportNginx(conf)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	changes, err := ImportDomains(ctx, client, domains, dryRun)
+	if err != nil {
+		logger(ctx).Infof("import nginx fail :%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, &types.ImportReport{Domains: domains, Changes: changes, Warnings: warnings, DryRun: dryRun})
+}
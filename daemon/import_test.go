@@ -0,0 +1,117 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zanecloud/zlb/api/types"
+)
+
+func TestImportNginx(t *testing.T) {
+	conf, err := ioutil.ReadFile("testdata/nginx.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	domains, warnings, err := ImportNginx(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byName := map[string]*types.Domain{}
+	var names []string
+	for _, d := range domains {
+		byName[d.Name] = d
+		names = append(names, d.Name)
+	}
+	if want := []string{"www.test.com", "test.com", "pinned.test.com"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("got domains %v, want %v", names, want)
+	}
+
+	paths := map[string]*types.DomainPath{}
+	for _, name := range []string{"www.test.com", "pinned.test.com"} {
+		for path, p := range byName[name].Paths {
+			paths[name+path] = p
+		}
+	}
+	if !reflect.DeepEqual(byName["test.com"].Paths, byName["www.test.com"].Paths) {
+		t.Errorf("the server names of a server block have different paths")
+	}
+
+	for _, c := range []struct {
+		path    string
+		servers []string
+		cfg     types.DomainCfg
+	}{
+		{"www.test.com/", []string{"10.0.0.1:8080", "10.0.0.2:8080"}, types.DomainCfg{
+			Path:      "/",
+			KeepAlive: 64,
+			Balancer:  &types.BalancerCfg{Algorithm: "weighted_round_robin", Weights: map[string]int{"10.0.0.1:8080": 3}},
+			Healthcheck: types.HealthCheckCfg{
+				Type: "http", Uri: "/status", Interval: 3000, Rise: 2, Fall: 5, Timeout: 1000,
+				Valid_statuses: "200,201,202,203,204,205,206,207,208,226,300,301,302,303,304,305,307,308",
+			},
+		}},
+		{"www.test.com/api/", []string{"10.0.1.1:9000", "10.0.1.2:9000"}, types.DomainCfg{
+			Path:        "/api/",
+			Balancer:    &types.BalancerCfg{Algorithm: "least_conn"},
+			Healthcheck: types.HealthCheckCfg{Type: "tcp"},
+		}},
+		{"www.test.com/session", []string{"10.0.2.1:80", "10.0.2.2:80"}, types.DomainCfg{
+			Path:     "/session",
+			Balancer: &types.BalancerCfg{Algorithm: "hash", Hash_on: "cookie", Hash_key: "sid"},
+		}},
+		{"pinned.test.com/", []string{"10.0.3.1:80", "10.0.3.2:80"}, types.DomainCfg{Path: "/", Sticky: true}},
+		{"pinned.test.com/remote", []string{"10.0.4.1:80"}, types.DomainCfg{Path: "/remote"}},
+		{"pinned.test.com/static", []string{"cdn.test.com:443"}, types.DomainCfg{Path: "/static"}},
+	} {
+		p, ok := paths[c.path]
+		if !ok {
+			t.Errorf("%s is not imported", c.path)
+			continue
+		}
+		if !reflect.DeepEqual(p.Servers, c.servers) {
+			t.Errorf("%s: got servers %v, want %v", c.path, p.Servers, c.servers)
+		}
+		if !reflect.DeepEqual(p.Cfg, &c.cfg) {
+			t.Errorf("%s: got cfg %+v, want %+v", c.path, p.Cfg, &c.cfg)
+		}
+		delete(paths, c.path)
+	}
+	for path := range paths {
+		t.Errorf("unexpected path %s", path)
+	}
+
+	for _, want := range []string{
+		"include mime.types not followed",
+		"backup server 10.0.0.3:8080 skipped",
+		"the weights of upstream pinned skipped",
+		"hash $remote_addr imported as round robin",
+		`location ~ \.php$ skipped`,
+		"location /fpm skipped, Healthcheck: ",
+		"server_name _ skipped",
+	} {
+		found := false
+		for _, w := range warnings {
+			found = found || strings.Contains(w, want)
+		}
+		if !found {
+			t.Errorf("no warning %q in %q", want, warnings)
+		}
+	}
+}
+
+func TestImportNginxUnsafePath(t *testing.T) {
+	conf := "server {\n    server_name a.com;\n    location \"/a b\" {\n        proxy_pass http://10.0.0.1;\n    }\n}\n"
+	domains, warnings, err := ImportNginx([]byte(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 0 {
+		t.Errorf("got domains %+v, want none", domains)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "invalid Path") {
+		t.Errorf("got warnings %q, want the invalid path", warnings)
+	}
+}
@@ -0,0 +1,102 @@
+package daemon
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+// the time a failed campaign is retried after
+const leaderRetryDelay = 5 * time.Second
+
+// leader campaigns for a consul lock and holds it for as long as it can, so
+// that the work which must not run twice runs on a single instance of a
+// cluster of zlb-api. The lock is campaigned for again once it is lost.
+type leader struct {
+	client *api.Client
+	key    string
+
+	mu   sync.RWMutex
+	held bool
+}
+
+func newLeader(client *api.Client, key string) *leader {
+	return &leader{client: client, key: key}
+}
+
+// IsLeader reports whether the lock is held.
+func (l *leader) IsLeader() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.held
+}
+
+func (l *leader) setHeld(held bool) {
+	l.mu.Lock()
+	l.held = held
+	l.mu.Unlock()
+}
+
+// Run campaigns for the lock until ctx is done. While the lock is held it
+// runs fn, when not nil, with a context which is cancelled once the lock is
+// lost, and releases the lock after fn has returned.
+func (l *leader) Run(ctx context.Context, fn func(context.Context)) {
+	for ctx.Err() == nil {
+		lock, lost, err := l.acquire(ctx)
+		if err != nil {
+			logrus.Warnf("acquire %s fail :%s", l.key, err.Error())
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(leaderRetryDelay):
+			}
+			continue
+		}
+		if lost == nil {
+			return
+		}
+		logrus.Infof("acquired %s, this instance is the leader", l.key)
+		l.setHeld(true)
+
+		leadCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if fn != nil {
+				fn(leadCtx)
+			}
+		}()
+		select {
+		case <-lost:
+			logrus.Warnf("lost %s, this instance is no longer the leader", l.key)
+		case <-ctx.Done():
+		}
+		l.setHeld(false)
+		cancel()
+		<-done
+		lock.Unlock()
+	}
+}
+
+// acquire blocks until the lock is held, lost is nil when ctx is done first.
+func (l *leader) acquire(ctx context.Context) (*api.Lock, <-chan struct{}, error) {
+	lock, err := l.client.LockOpts(&api.LockOptions{Key: l.key, SessionName: "zlb-api leader"})
+	if err != nil {
+		return nil, nil, err
+	}
+	stop := make(chan struct{})
+	acquired := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			close(stop)
+		case <-acquired:
+		}
+	}()
+	lost, err := lock.Lock(stop)
+	close(acquired)
+	return lock, lost, err
+}
@@ -0,0 +1,315 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zanecloud/zlb/api/opts"
+	"github.com/zanecloud/zlb/api/types"
+)
+
+// the buckets of the prometheus client libraries, in seconds
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	httpRequests = newCounter("zlb_api_http_requests_total",
+		"HTTP requests handled, by route, method and status code.", "route", "method", "code")
+	httpDuration = newHistogram("zlb_api_http_request_duration_seconds",
+		"Latency of the HTTP requests, by route, method and status code.", "route", "method", "code")
+	consulDuration = newHistogram("zlb_api_consul_request_duration_seconds",
+		"Latency of the consul requests, by operation.", "operation")
+	consulErrors = newCounter("zlb_api_consul_request_errors_total",
+		"Consul requests which failed or were answered with an error status, by operation.", "operation")
+	spansDropped = newCounter("zlb_api_trace_spans_dropped_total",
+		"Spans dropped because the export queue was full.")
+	treeParseErrors = newCounter("zlb_api_tree_parse_errors_total",
+		"Scrapes of the metrics whose zlb/ tree could not be parsed, they have no tree gauges.")
+)
+
+// metric is a counter, or a histogram when it has buckets, with labels.
+type metric struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	values []string
+	count  uint64
+	sum    float64
+	counts []uint64 // per bucket, not cumulated
+}
+
+func newCounter(name, help string, labels ...string) *metric {
+	return &metric{name: name, help: help, labels: labels, series: map[string]*series{}}
+}
+
+func newHistogram(name, help string, labels ...string) *metric {
+	m := newCounter(name, help, labels...)
+	m.buckets = defaultBuckets
+	return m
+}
+
+func (m *metric) get(values []string) *series {
+	key := strings.Join(values, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{values: values, counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Inc adds one to the counter of the label values.
+func (m *metric) Inc(values ...string) {
+	m.mu.Lock()
+	m.get(values).count++
+	m.mu.Unlock()
+}
+
+// Observe adds v to the histogram of the label values.
+func (m *metric) Observe(v float64, values ...string) {
+	m.mu.Lock()
+	s := m.get(values)
+	s.count++
+	s.sum += v
+	for i, b := range m.buckets {
+		if v <= b {
+			s.counts[i]++
+			break
+		}
+	}
+	m.mu.Unlock()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelPairs(names, values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// write writes the metric in the prometheus text format.
+func (m *metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	kind := "counter"
+	if m.buckets != nil {
+		kind = "histogram"
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, kind)
+
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	// a counter without labels is 0 until it is incremented
+	if len(keys) == 0 && len(m.labels) == 0 && m.buckets == nil {
+		fmt.Fprintf(w, "%s 0\n", m.name)
+	}
+	for _, k := range keys {
+		s := m.series[k]
+		if m.buckets == nil {
+			fmt.Fprintf(w, "%s%s %d\n", m.name, labelPairs(m.labels, s.values), s.count)
+			continue
+		}
+		var cumulated uint64
+		for i, b := range m.buckets {
+			cumulated += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labelPairs(m.labels, s.values, "le", formatFloat(b)), cumulated)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labelPairs(m.labels, s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labelPairs(m.labels, s.values), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, labelPairs(m.labels, s.values), s.count)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(v))
+}
+
+// statusRecorder keeps the status code and counts the bytes written by a
+// handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// instrument gives the requests of a route an id and a logger, runs them in
+// a span of t, counts them, observes their latency and writes their access
+// log.
+func instrument(opts opts.Options, t *tracer, route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx, sp := t.start(r.Context(), r.Method+" "+route, spanKindServer,
+			r.Header.Get(traceparentHeader), r.Header.Get(tracestateHeader))
+		r, entry := withRequestLogger(w, r.WithContext(ctx))
+		rec := &statusRecorder{ResponseWriter: w}
+		h(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		latency := time.Since(start)
+		code := strconv.Itoa(rec.status)
+		httpRequests.Inc(route, r.Method, code)
+		httpDuration.Observe(latency.Seconds(), route, r.Method, code)
+		accessLog(entry, opts, route, r, rec, latency)
+
+		if sp != nil {
+			sp.SetAttr("http.method", r.Method)
+			sp.SetAttr("http.route", route)
+			sp.SetAttr("http.target", r.RequestURI)
+			sp.SetAttr("http.status_code", rec.status)
+			sp.SetAttr("net.peer.addr", r.RemoteAddr)
+			sp.SetAttr("zlb.request_id", w.Header().Get(requestIDHeader))
+			if domain := requestDomain(r); domain != "" {
+				sp.SetAttr("zlb.domain", domain)
+			}
+			if rec.status >= 500 {
+				sp.SetError(http.StatusText(rec.status))
+			}
+			t.finish(sp)
+		}
+	}
+}
+
+// consulTransport observes the latency and the errors of the requests the
+// consul client sends.
+type consulTransport struct {
+	next http.RoundTripper
+}
+
+// consulOperation names a consul request after its endpoint, e.g. kv.get,
+// kv.list, txn or status.leader. Blocking queries are told apart because
+// their latency is the wait time.
+func consulOperation(r *http.Request) string {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/"), "/")
+	q := r.URL.Query()
+	var op string
+	switch {
+	case parts[0] == "kv":
+		switch r.Method {
+		case "GET":
+			op = "kv.get"
+			if _, ok := q["recurse"]; ok {
+				op = "kv.list"
+			} else if _, ok := q["keys"]; ok {
+				op = "kv.keys"
+			}
+		case "PUT":
+			op = "kv.put"
+		case "DELETE":
+			op = "kv.delete"
+		default:
+			op = "kv." + strings.ToLower(r.Method)
+		}
+	case parts[0] == "agent" && len(parts) >= 3:
+		op = strings.Join(parts[:3], ".")
+	case len(parts) >= 2:
+		op = parts[0] + "." + parts[1]
+	default:
+		op = parts[0]
+	}
+	if q.Get("index") != "" && q.Get("index") != "0" {
+		op += ".blocking"
+	}
+	return op
+}
+
+func (t *consulTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	op := consulOperation(r)
+	start := time.Now()
+	resp, err := t.next.RoundTrip(r)
+	consulDuration.Observe(time.Since(start).Seconds(), op)
+	// a 404 is how consul answers a missing key
+	if err != nil || resp.StatusCode >= 400 && resp.StatusCode != http.StatusNotFound {
+		consulErrors.Inc(op)
+	}
+	return resp, err
+}
+
+func getMetrics(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	var gauges bytes.Buffer
+	pairs, index, err := readTree(ctx, r, zlbPrefix)
+	if err == nil {
+		domains, err := ParseDomains(pairs)
+		if err != nil {
+			logger(ctx).Warnf("metrics: parse the zlb/ tree fail :%s", err.Error())
+			treeParseErrors.Inc()
+		} else {
+			writeTreeGauges(&gauges, domains, index)
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, m := range []*metric{httpRequests, httpDuration, consulDuration, consulErrors, spansDropped, treeParseErrors} {
+		m.write(&buf)
+	}
+	buf.Write(gauges.Bytes())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+func writeTreeGauges(buf *bytes.Buffer, domains []*types.Domain, index uint64) {
+	var paths, servers, filters int
+	for _, d := range domains {
+		paths += len(d.Paths)
+		for _, p := range d.Paths {
+			servers += len(p.Servers)
+		}
+		for _, f := range d.CookieFilters {
+			if f.Lifecycle > 0 {
+				filters++
+			}
+		}
+	}
+	writeGauge(buf, "zlb_api_domains", "Domains in the zlb/ tree.", float64(len(domains)))
+	writeGauge(buf, "zlb_api_paths", "Domain paths in the zlb/ tree.", float64(paths))
+	writeGauge(buf, "zlb_api_servers", "Backend servers of all domain paths.", float64(servers))
+	writeGauge(buf, "zlb_api_cookie_filters_active", "Cookie filters with a lifecycle greater than 0.", float64(filters))
+	writeGauge(buf, "zlb_api_tree_index", "Consul index of the zlb/ tree the gauges were computed at.", float64(index))
+}
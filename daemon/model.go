@@ -0,0 +1,103 @@
+package daemon
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/zanecloud/zlb/api/types"
+)
+
+func encodePath(path string) string {
+	if path == "" {
+		path = "/"
+	}
+	return "path_" + base64.URLEncoding.EncodeToString([]byte(path))
+}
+
+func cfgKey(domain, path string) string {
+	return fmt.Sprintf("zlb/%s/cfg/%s", domain, encodePath(path))
+}
+
+func serverKey(domain, path, server string) string {
+	return fmt.Sprintf("zlb/%s/server/%s/%s", domain, encodePath(path), server)
+}
+
+func ckfilterKey(domain, name, value string) string {
+	return fmt.Sprintf("zlb/%s/ckfilter/%s/%s", domain, name, value)
+}
+
+// ParseDomains turns the pairs of the zlb/ tree into domains sorted by name.
+// The error names every key whose value is invalid.
+func ParseDomains(pairs api.KVPairs) ([]*types.Domain, error) {
+	domains := map[string]*types.Domain{}
+	var invalid []string
+	for _, pair := range pairs {
+		parts := strings.Split(strings.TrimPrefix(pair.Key, zlbPrefix), "/")
+		if len(parts) < 3 || parts[0] == "" {
+			continue
+		}
+		d, ok := domains[parts[0]]
+		if !ok {
+			d = &types.Domain{Name: parts[0], Paths: map[string]*types.DomainPath{}}
+			domains[d.Name] = d
+		}
+		switch {
+		case parts[1] == "cfg" && len(parts) == 3:
+			cfg := &types.DomainCfg{}
+			if err := json.Unmarshal(pair.Value, cfg); err != nil {
+				invalid = append(invalid, fmt.Sprintf("invalid cfg %s: %s", pair.Key, err.Error()))
+				continue
+			}
+			p := d.EnsurePath(decodePath(parts[2]))
+			cfg.Path = p.Path
+			p.Cfg = cfg
+		case parts[1] == "server" && len(parts) == 4:
+			if parts[3] == "" {
+				continue
+			}
+			p := d.EnsurePath(decodePath(parts[2]))
+			p.Servers = append(p.Servers, parts[3])
+		case parts[1] == "ckfilter" && len(parts) == 4:
+			lifecycle, err := strconv.ParseInt(string(pair.Value), 10, 64)
+			if err != nil && len(pair.Value) > 0 {
+				invalid = append(invalid, fmt.Sprintf("invalid lifecycle %s: %q", pair.Key, pair.Value))
+				continue
+			}
+			d.CookieFilters = append(d.CookieFilters, &types.CookieFilter{Name: parts[2], Value: parts[3], Lifecycle: lifecycle})
+		}
+	}
+
+	if len(invalid) > 0 {
+		return nil, errors.New(strings.Join(invalid, "; "))
+	}
+
+	list := make([]*types.Domain, 0, len(domains))
+	for _, d := range domains {
+		for _, p := range d.Paths {
+			sort.Strings(p.Servers)
+		}
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// LoadDomains reads the named domain, or all domains when name is empty,
+// straight from consul.
+func LoadDomains(client *api.Client, name string) ([]*types.Domain, error) {
+	prefix := zlbPrefix
+	if name != "" {
+		prefix += name + "/"
+	}
+	pairs, _, err := client.KV().List(prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+	return ParseDomains(pairs)
+}
@@ -0,0 +1,267 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/zanecloud/zlb/api/types"
+)
+
+// defaults applied by the data plane when a HealthCheckCfg field is zero
+const (
+	defaultInterval    = 2000
+	defaultTimeout     = 1000
+	defaultFall        = 3
+	defaultRise        = 2
+	defaultConcurrency = 10
+	defaultKeepAlive   = 10
+)
+
+// default of the data plane when PassiveCheckCfg.Ejection_time is zero, in ms
+const defaultEjectionTime = 30000
+
+var nonWord = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// upstreamName returns the name of the upstream/backend of a domain path. The
+// domain and path are made words, which a.b and a_b share, so a hash of them
+// as they are ends the name.
+func upstreamName(domain, path string) string {
+	name := "zlb_" + strings.Trim(nonWord.ReplaceAllString(domain, "_"), "_")
+	if p := strings.Trim(nonWord.ReplaceAllString(path, "_"), "_"); p != "" {
+		name += "_" + p
+	}
+	h := fnv.New32a()
+	io.WriteString(h, domain+"\x00"+path)
+	return fmt.Sprintf("%s_%08x", name, h.Sum32())
+}
+
+func orDefault(v, def int) int {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+func pathCfg(p *types.DomainPath) *types.DomainCfg {
+	if p.Cfg == nil {
+		return &types.DomainCfg{Path: p.Path}
+	}
+	return p.Cfg
+}
+
+// passiveThreshold returns the failed requests which eject a server, the
+// smallest of the thresholds set since the data planes count all the
+// failures together.
+func passiveThreshold(p *types.PassiveCheckCfg) int {
+	n := p.Consecutive_5xx
+	if n == 0 || p.Consecutive_errors > 0 && p.Consecutive_errors < n {
+		n = p.Consecutive_errors
+	}
+	return n
+}
+
+// serverWeight returns the weight of a server of a weighted round robin
+// balancer, 0 otherwise.
+func serverWeight(b *types.BalancerCfg, server string) int {
+	if b == nil || b.Algorithm != "weighted_round_robin" {
+		return 0
+	}
+	return orDefault(b.Weights[server], 1)
+}
+
+// nginxBalancer returns the directive of the algorithm of b, round robin is
+// the default of nginx.
+func nginxBalancer(b *types.BalancerCfg) string {
+	if b == nil {
+		return ""
+	}
+	switch b.Algorithm {
+	case "least_conn":
+		return "least_conn;"
+	case "random_two":
+		return "random two least_conn;"
+	case "hash":
+		switch b.Hash_on {
+		case "header":
+			return fmt.Sprintf("hash $http_%s consistent;", strings.ToLower(nonWord.ReplaceAllString(b.Hash_key, "_")))
+		case "cookie":
+			return fmt.Sprintf("hash $cookie_%s consistent;", b.Hash_key)
+		case "uri":
+			return "hash $request_uri consistent;"
+		}
+	}
+	return ""
+}
+
+func validStatuses(cfg *types.HealthCheckCfg) []string {
+	var statuses []string
+	for _, s := range strings.Split(cfg.Valid_statuses, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			statuses = append(statuses, s)
+		}
+	}
+	return statuses
+}
+
+// RenderNginx writes an nginx/OpenResty configuration snippet, to be included
+// in the http block, with one upstream per domain path and one server block
+// per domain. Http and https health checks are rendered as
+// lua-resty-upstream-healthcheck checkers spawned from init_worker_by_lua_block,
+// passive checks as the max_fails of the servers.
+func RenderNginx(w io.Writer, domains []*types.Domain) error {
+	var upstreams, servers, checkers bytes.Buffer
+
+	for _, d := range domains {
+		fmt.Fprintf(&servers, "server {\n    listen 80;\n    server_name %s;\n", d.Name)
+		for _, p := range d.SortedPaths() {
+			name := upstreamName(d.Name, p.Path)
+			// the paths written before they were validated are not rendered
+			if err := types.ValidatePath(p.Path); err != nil {
+				fmt.Fprintf(&servers, "\n    # %s: skipped, invalid path (%s)\n", name, err.Error())
+				continue
+			}
+			if len(p.Servers) == 0 {
+				fmt.Fprintf(&servers, "\n    # %s%s has no servers\n", d.Name, p.Path)
+				continue
+			}
+			cfg := pathCfg(p)
+
+			fmt.Fprintf(&upstreams, "upstream %s {\n", name)
+			if cfg.Sticky {
+				fmt.Fprintf(&upstreams, "    ip_hash;\n")
+			}
+			if balancer := nginxBalancer(cfg.Balancer); balancer != "" {
+				fmt.Fprintf(&upstreams, "    %s\n", balancer)
+			}
+			passive := ""
+			if cfg.Passive != nil {
+				// nginx counts the failures within fail_timeout rather than in a row
+				passive = fmt.Sprintf(" max_fails=%d fail_timeout=%ds", passiveThreshold(cfg.Passive),
+					(orDefault(cfg.Passive.Ejection_time, defaultEjectionTime)+999)/1000)
+				if cfg.Passive.Max_ejection_percent > 0 {
+					fmt.Fprintf(&upstreams, "    # Max_ejection_percent is not supported by nginx\n")
+				}
+			}
+			for _, s := range p.Servers {
+				fmt.Fprintf(&upstreams, "    server %s", s)
+				if weight := serverWeight(cfg.Balancer, s); weight > 0 {
+					fmt.Fprintf(&upstreams, " weight=%d", weight)
+				}
+				fmt.Fprintf(&upstreams, "%s;\n", passive)
+			}
+			fmt.Fprintf(&upstreams, "    keepalive %d;\n}\n\n", orDefault(cfg.KeepAlive, defaultKeepAlive))
+
+			fmt.Fprintf(&servers, "\n    location %s {\n", p.Path)
+			fmt.Fprintf(&servers, "        proxy_pass http://%s;\n", name)
+			fmt.Fprintf(&servers, "        proxy_http_version 1.1;\n")
+			fmt.Fprintf(&servers, "        proxy_set_header Connection \"\";\n")
+			fmt.Fprintf(&servers, "        proxy_set_header Host $host;\n")
+			if cfg.Passive != nil && cfg.Passive.Consecutive_5xx > 0 {
+				fmt.Fprintf(&servers, "        proxy_next_upstream error timeout http_500 http_502 http_503 http_504;\n")
+			}
+			fmt.Fprintf(&servers, "    }\n")
+
+			renderLuaChecker(&checkers, d.Name, name, &cfg.Healthcheck)
+		}
+		fmt.Fprintf(&servers, "}\n\n")
+	}
+
+	if checkers.Len() > 0 {
+		fmt.Fprintf(w, "lua_shared_dict healthcheck 1m;\n\n")
+	}
+	if _, err := upstreams.WriteTo(w); err != nil {
+		return err
+	}
+	if _, err := servers.WriteTo(w); err != nil {
+		return err
+	}
+	if checkers.Len() > 0 {
+		fmt.Fprintf(w, "init_worker_by_lua_block {\n    local hc = require \"resty.upstream.healthcheck\"\n")
+		checkers.WriteTo(w)
+		fmt.Fprintf(w, "}\n")
+	}
+	return nil
+}
+
+func renderLuaChecker(w *bytes.Buffer, domain, upstream string, hc *types.HealthCheckCfg) {
+	if hc.Type == "" {
+		return
+	}
+	if hc.Type != "http" && hc.Type != "https" {
+		fmt.Fprintf(w, "\n    -- %s: %s checks are not supported by lua-resty-upstream-healthcheck\n", upstream, hc.Type)
+		return
+	}
+	uri := hc.Uri
+	if uri == "" {
+		uri = "/"
+	}
+	if err := types.ValidatePath(uri); err != nil {
+		fmt.Fprintf(w, "\n    -- %s: skipped, invalid Uri (%s)\n", upstream, err.Error())
+		return
+	}
+	fmt.Fprintf(w, "\n    local ok, err = hc.spawn_checker{\n")
+	fmt.Fprintf(w, "        shm = \"healthcheck\",\n")
+	fmt.Fprintf(w, "        upstream = %q,\n", upstream)
+	fmt.Fprintf(w, "        type = %q,\n", hc.Type)
+	if hc.Type == "https" {
+		sni := hc.Sni
+		if sni == "" {
+			sni = domain
+		}
+		fmt.Fprintf(w, "        host = %q,\n", sni)
+		fmt.Fprintf(w, "        ssl_verify = %t,\n", !hc.Skip_verify)
+	}
+	fmt.Fprintf(w, "        http_req = \"GET %s HTTP/1.0\\r\\nHost: %s\\r\\n\\r\\n\",\n", uri, domain)
+	fmt.Fprintf(w, "        interval = %d,\n", orDefault(hc.Interval, defaultInterval))
+	fmt.Fprintf(w, "        timeout = %d,\n", orDefault(hc.Timeout, defaultTimeout))
+	fmt.Fprintf(w, "        fall = %d,\n", orDefault(hc.Fall, defaultFall))
+	fmt.Fprintf(w, "        rise = %d,\n", orDefault(hc.Rise, defaultRise))
+	if statuses := validStatuses(hc); len(statuses) > 0 {
+		fmt.Fprintf(w, "        valid_statuses = {%s},\n", strings.Join(statuses, ", "))
+	}
+	fmt.Fprintf(w, "        concurrency = %d,\n", orDefault(hc.Concurrency, defaultConcurrency))
+	fmt.Fprintf(w, "    }\n")
+	fmt.Fprintf(w, "    if not ok then\n        ngx.log(ngx.ERR, \"failed to spawn health checker for %s: \", err)\n    end\n", upstream)
+}
+
+// renderHandler serves the rendering of the domain given by ?domain=, or of
+// all domains, from the cached zlb/ tree.
+func renderHandler(render func(io.Writer, []*types.Domain) error) Handler {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		prefix := zlbPrefix
+		name := r.URL.Query().Get("domain")
+		if name != "" {
+			prefix += name + "/"
+		}
+		pairs, index, err := readTree(ctx, r, prefix)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		domains, err := ParseDomains(pairs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if name != "" && len(domains) == 0 {
+			http.Error(w, "No such domain", http.StatusNotFound)
+			return
+		}
+
+		var buf bytes.Buffer
+		if err := render(&buf, domains); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		setIndexHeader(w, index)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		buf.WriteTo(w)
+	}
+}
@@ -0,0 +1,94 @@
+package daemon
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/zanecloud/zlb/api/types"
+)
+
+var unsafePaths = []string{
+	"api",
+	"/a b",
+	"/a\tb",
+	"/a\r\n    return 200;",
+	"/a;",
+	"/a{",
+	"/a}",
+	`/a"`,
+	"/a'",
+	"/a`",
+	`/a\`,
+	"/a#b",
+	"/a\x00",
+}
+
+func TestValidatePath(t *testing.T) {
+	for _, p := range []string{"/", "/api", "/api/v1.2/", "/~user/a-b_c", "/a%20b", "/a?b=c&d"} {
+		if err := types.ValidatePath(p); err != nil {
+			t.Errorf("ValidatePath(%q) = %v, want nil", p, err)
+		}
+	}
+	for _, p := range unsafePaths {
+		if err := types.ValidatePath(p); err == nil {
+			t.Errorf("ValidatePath(%q) = nil, want an error", p)
+		}
+		if err := (&types.DomainCfg{Path: p}).Validate(); err == nil {
+			t.Errorf("the cfg of the path %q is valid", p)
+		}
+		cfg := &types.DomainCfg{Healthcheck: types.HealthCheckCfg{Type: "http", Uri: p}}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("the check of the uri %q is valid", p)
+		}
+	}
+}
+
+func TestRenderNginx(t *testing.T) {
+	d := &types.Domain{Name: "www.test.com"}
+	api := d.EnsurePath("/api")
+	api.Servers = []string{"10.0.0.1:80"}
+	api.Cfg = &types.DomainCfg{Path: "/api", Healthcheck: types.HealthCheckCfg{Type: "http", Uri: "/health"}}
+
+	var buf bytes.Buffer
+	if err := RenderNginx(&buf, []*types.Domain{d}); err != nil {
+		t.Fatal(err)
+	}
+	name := upstreamName(d.Name, "/api")
+	for _, want := range []string{
+		"upstream " + name + " {\n    server 10.0.0.1:80;\n",
+		"\n    location /api {\n        proxy_pass http://" + name + ";\n",
+		`http_req = "GET /health HTTP/1.0\r\nHost: www.test.com\r\n\r\n",`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing %q in\n%s", want, buf.String())
+		}
+	}
+}
+
+// the paths and the uris of the tree are rendered only when they are valid,
+// those written directly into consul are not.
+func TestRenderNginxUnsafe(t *testing.T) {
+	for _, p := range unsafePaths {
+		d := &types.Domain{Name: "www.test.com"}
+		d.EnsurePath(p).Servers = []string{"10.0.0.1:80"}
+		check := d.EnsurePath("/")
+		check.Servers = []string{"10.0.0.2:80"}
+		check.Cfg = &types.DomainCfg{Path: "/", Healthcheck: types.HealthCheckCfg{Type: "http", Uri: p}}
+
+		var buf bytes.Buffer
+		if err := RenderNginx(&buf, []*types.Domain{d}); err != nil {
+			t.Fatal(err)
+		}
+		out := buf.String()
+		if strings.Contains(out, "location "+p) || strings.Contains(out, "10.0.0.1:80") {
+			t.Errorf("the path %q is rendered:\n%s", p, out)
+		}
+		if strings.Contains(out, "GET "+p) || strings.Contains(out, "spawn_checker") {
+			t.Errorf("the uri %q is rendered:\n%s", p, out)
+		}
+		if !strings.Contains(out, "\n    location / {\n") {
+			t.Errorf("the valid path / is not rendered:\n%s", out)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// nginxDirective is one simple or block directive of an nginx configuration.
+type nginxDirective struct {
+	Name  string
+	Args  []string
+	Block []*nginxDirective
+	Line  int
+}
+
+type nginxToken struct {
+	text   string
+	quoted bool
+	line   int
+}
+
+func tokenizeNginx(conf string) ([]nginxToken, error) {
+	var tokens []nginxToken
+	line := 1
+	for i := 0; i < len(conf); {
+		c := conf[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(conf) && conf[i] != '\n' {
+				i++
+			}
+		case c == '{' || c == '}' || c == ';':
+			tokens = append(tokens, nginxToken{text: string(c), line: line})
+			i++
+		case c == '"' || c == '\'':
+			start := line
+			var b bytes.Buffer
+			i++
+			for ; i < len(conf) && conf[i] != c; i++ {
+				ch := conf[i]
+				if ch == '\\' && i+1 < len(conf) {
+					i++
+					switch ch = conf[i]; ch {
+					case 'n':
+						ch = '\n'
+					case 'r':
+						ch = '\r'
+					case 't':
+						ch = '\t'
+					}
+				} else if ch == '\n' {
+					line++
+				}
+				b.WriteByte(ch)
+			}
+			if i >= len(conf) {
+				return nil, fmt.Errorf("line %d: unterminated string", start)
+			}
+			i++
+			tokens = append(tokens, nginxToken{text: b.String(), quoted: true, line: start})
+		default:
+			start := i
+			for i < len(conf) && !strings.ContainsRune(" \t\r\n{};#\"'", rune(conf[i])) {
+				i++
+			}
+			tokens = append(tokens, nginxToken{text: conf[start:i], line: line})
+		}
+	}
+	return tokens, nil
+}
+
+// parseNginx parses an nginx configuration into its tree of directives.
+func parseNginx(conf string) ([]*nginxDirective, error) {
+	tokens, err := tokenizeNginx(conf)
+	if err != nil {
+		return nil, err
+	}
+	pos := 0
+	block, err := parseNginxBlock(tokens, &pos, false)
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+func parseNginxBlock(tokens []nginxToken, pos *int, nested bool) ([]*nginxDirective, error) {
+	var block []*nginxDirective
+	var cur *nginxDirective
+	for *pos < len(tokens) {
+		t := tokens[*pos]
+		*pos++
+		if t.quoted {
+			if cur == nil {
+				return nil, fmt.Errorf("line %d: unexpected string %q", t.line, t.text)
+			}
+			cur.Args = append(cur.Args, t.text)
+			continue
+		}
+		switch t.text {
+		case ";":
+			if cur == nil {
+				return nil, fmt.Errorf("line %d: unexpected \";\"", t.line)
+			}
+			block = append(block, cur)
+			cur = nil
+		case "{":
+			if cur == nil {
+				return nil, fmt.Errorf("line %d: unexpected \"{\"", t.line)
+			}
+			children, err := parseNginxBlock(tokens, pos, true)
+			if err != nil {
+				return nil, err
+			}
+			cur.Block = children
+			if cur.Block == nil {
+				cur.Block = []*nginxDirective{}
+			}
+			block = append(block, cur)
+			cur = nil
+		case "}":
+			if !nested || cur != nil {
+				return nil, fmt.Errorf("line %d: unexpected \"}\"", t.line)
+			}
+			return block, nil
+		default:
+			if cur == nil {
+				cur = &nginxDirective{Name: t.text, Line: t.line}
+			} else {
+				cur.Args = append(cur.Args, t.text)
+			}
+		}
+	}
+	if nested {
+		return nil, fmt.Errorf("unexpected end of file, expecting \"}\"")
+	}
+	if cur != nil {
+		return nil, fmt.Errorf("line %d: unexpected end of file, expecting \";\"", cur.Line)
+	}
+	return block, nil
+}
+
+// findNginx returns every directive named name, searching nested blocks too.
+func findNginx(block []*nginxDirective, name string) []*nginxDirective {
+	var found []*nginxDirective
+	for _, d := range block {
+		if d.Name == name {
+			found = append(found, d)
+		} else if d.Block != nil {
+			found = append(found, findNginx(d.Block, name)...)
+		}
+	}
+	return found
+}
+
+func firstNginx(block []*nginxDirective, name string) *nginxDirective {
+	for _, d := range block {
+		if d.Name == name {
+			return d
+		}
+	}
+	return nil
+}
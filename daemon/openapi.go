@@ -0,0 +1,277 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/zanecloud/zlb/api/opts"
+	"github.com/zanecloud/zlb/api/types"
+)
+
+const openAPIPath = "/openapi.json"
+
+// routeDoc describes a route of routers for the OpenAPI document. Request and
+// Response are zero values of the json bodies, their schemas are generated
+// from the Go types so that the document follows the code.
+type routeDoc struct {
+	ID           string
+	Summary      string
+	Tag          string
+	Query        []string    // names of queryParams
+	Request      interface{} // nil when the route has no body
+	RequestType  string      // content type of the body, application/json by default
+	Response     interface{} // nil when the route answers "ok"
+	ResponseType string      // content type of the answer, application/json by default
+	DryRun       bool        // the route answers an ApplyReport instead of its response on dry_run
+}
+
+var queryParams = map[string]map[string]interface{}{
+	"consistent": {"description": "bypass the cache and read consul with a consistent query", "schema": map[string]interface{}{"type": "boolean"}},
+	"dry_run":    {"description": "only return the keys which would be written or deleted, or validate the request for the consul agent routes", "schema": map[string]interface{}{"type": "boolean"}},
+	"domain":     {"description": "domain to render, all the domains when empty", "schema": map[string]interface{}{"type": "string"}},
+	"prune":      {"description": "delete the domains which are not declared", "schema": map[string]interface{}{"type": "boolean"}},
+	"path":       {"description": "only probe this path of the domain", "schema": map[string]interface{}{"type": "string"}},
+	"node":       {"description": "the node of the instance, the first node which has the ID when empty", "schema": map[string]interface{}{"type": "string"}},
+	"mode":       {"description": "merge writes the archive keys, replace also deletes the keys which are not in the archive", "schema": map[string]interface{}{"type": "string", "enum": []string{"merge", "replace"}, "default": "merge"}},
+}
+
+var routeDocs = map[string]routeDoc{
+	"/zlb/domains/list":                         {ID: "listDomains", Tag: "domains", Summary: "List the domain names", Query: []string{"consistent"}, Response: []string{}},
+	"/zlb/domains/{name:.*}/inspect":            {ID: "inspectDomain", Tag: "domains", Summary: "Return the keys of a domain exploded into a tree", Query: []string{"consistent"}, Response: map[string]interface{}{}},
+	"/zlb/domains/{name:.*}/create":             {ID: "createDomain", Tag: "domains", Summary: "Create the cfg of a domain path", Query: []string{"dry_run"}, Request: types.DomainCfg{}, DryRun: true},
+	"/zlb/domains/{name:.*}/update":             {ID: "updateDomain", Tag: "domains", Summary: "Update the cfg of a domain path", Query: []string{"dry_run"}, Request: types.DomainCfg{}, DryRun: true},
+	"/zlb/domains/{name:.*}/remove":             {ID: "removeDomain", Tag: "domains", Summary: "Remove a domain with its paths, servers and cookie filters", Query: []string{"dry_run"}, DryRun: true},
+	"/zlb/domains/{name:.*}/setCookieFilter":    {ID: "setCookieFilter", Tag: "cookie filters", Summary: "Set the filter on a cookie value", Query: []string{"dry_run"}, Request: types.CookieFilter{}, DryRun: true},
+	"/zlb/domains/{name:.*}/listCookieFilters":  {ID: "listCookieFilters", Tag: "cookie filters", Summary: "List the cookie filters of a domain", Query: []string{"consistent"}, Response: []types.CookieFilter{}},
+	"/zlb/domains/{name:.*}/deleteCookieFilter": {ID: "deleteCookieFilter", Tag: "cookie filters", Summary: "Delete the filter on a cookie value, or on all values when Value is empty", Query: []string{"dry_run"}, Request: types.CookieFilter{}, DryRun: true},
+	"/zlb/domains/{name:.*}/addServers":         {ID: "addServers", Tag: "servers", Summary: "Add servers to a domain path, a conflict when they are synced from a consul service", Query: []string{"dry_run"}, Request: types.ServerList{}, DryRun: true},
+	"/zlb/domains/{name:.*}/removeServers":      {ID: "removeServers", Tag: "servers", Summary: "Remove servers from a domain path, a conflict when they are synced from a consul service", Query: []string{"dry_run"}, Request: types.ServerList{}, DryRun: true},
+	"/zlb/domains/{name:.*}/status":             {ID: "domainStatus", Tag: "status", Summary: "Return the nodes which see the servers of a domain up and down", Query: []string{"consistent"}, Response: types.DomainHealth{}},
+	"/zlb/domains/{name:.*}/probe":              {ID: "probeDomain", Tag: "status", Summary: "Run the health checks of the paths of a domain against their servers now", Query: []string{"consistent", "path"}, Response: []types.PathProbe{}},
+	"/zlb/render/nginx":                         {ID: "renderNginx", Tag: "render", Summary: "Render the nginx configuration of a domain", Query: []string{"domain"}, Response: "", ResponseType: "text/plain"},
+	"/zlb/render/haproxy":                       {ID: "renderHaproxy", Tag: "render", Summary: "Render the haproxy configuration of a domain", Query: []string{"domain"}, Response: "", ResponseType: "text/plain"},
+	"/zlb/import/nginx":                         {ID: "importNginx", Tag: "state", Summary: "Import the upstreams and server blocks of an nginx configuration", Query: []string{"dry_run"}, Request: "", RequestType: "text/plain", Response: types.ImportReport{}},
+	"/zlb/apply":                                {ID: "apply", Tag: "state", Summary: "Make the declared domains match a desired state file, in yaml or json", Query: []string{"dry_run", "prune"}, Request: types.DesiredState{}, Response: types.ApplyReport{}},
+	"/zlb/export":                               {ID: "export", Tag: "state", Summary: "Export the zlb/ tree as an archive", Response: types.Archive{}},
+	"/zlb/restore":                              {ID: "restore", Tag: "state", Summary: "Restore an archive, gzip compressed or not", Query: []string{"dry_run", "mode"}, Request: types.Archive{}, Response: types.ApplyReport{}},
+	"/zlb/webhooks/list":                        {ID: "listWebhooks", Tag: "webhooks", Summary: "List the webhooks, without their secrets", Response: []types.Webhook{}},
+	"/zlb/webhooks/create":                      {ID: "createWebhook", Tag: "webhooks", Summary: "Create a webhook", Query: []string{"dry_run"}, Request: types.Webhook{}, Response: types.Webhook{}, DryRun: true},
+	"/zlb/webhooks/{id}/inspect":                {ID: "inspectWebhook", Tag: "webhooks", Summary: "Return a webhook, without its secret", Response: types.Webhook{}},
+	"/zlb/webhooks/{id}/update":                 {ID: "updateWebhook", Tag: "webhooks", Summary: "Replace a webhook, the secret is kept when empty", Query: []string{"dry_run"}, Request: types.Webhook{}, Response: types.Webhook{}, DryRun: true},
+	"/zlb/webhooks/{id}/remove":                 {ID: "removeWebhook", Tag: "webhooks", Summary: "Remove a webhook and its dead letters", Query: []string{"dry_run"}, DryRun: true},
+	"/zlb/webhooks/{id}/deadletters":            {ID: "listDeadLetters", Tag: "webhooks", Summary: "List the events which could not be delivered to a webhook", Response: []types.DeadLetter{}},
+	"/zlb/services/list":                        {ID: "listServices", Tag: "services", Summary: "List the instances of the services of the consul catalog", Response: []types.Service{}},
+	"/zlb/services/create":                      {ID: "registerService", Tag: "services", Summary: "Register a service with the consul agent, an existing ID is replaced, dry_run only validates it", Query: []string{"dry_run"}, Request: types.Service{}, Response: types.Service{}},
+	"/zlb/services/{id}/inspect":                {ID: "inspectService", Tag: "services", Summary: "Return an instance of the consul catalog by service ID", Query: []string{"node"}, Response: types.Service{}},
+	"/zlb/services/{id}/deregister":             {ID: "deregisterService", Tag: "services", Summary: "Deregister a service and its checks from the consul agent, dry_run only checks that it exists", Query: []string{"dry_run"}},
+	"/zlb/status/report":                        {ID: "reportStatus", Tag: "status", Summary: "Store the state of the backends seen by an LB node, replacing its previous report", Query: []string{"dry_run"}, Request: types.NodeStatus{}, DryRun: true},
+	"/zlb/status/nodes":                         {ID: "listNodeStatus", Tag: "status", Summary: "List the last report of every LB node", Response: []types.NodeStatus{}},
+	"/zlb/status/nodes/{node}/remove":           {ID: "removeNodeStatus", Tag: "status", Summary: "Remove the report of a decommissioned LB node", Query: []string{"dry_run"}, DryRun: true},
+	"/metrics":                                  {ID: "metrics", Tag: "monitoring", Summary: "Metrics in the prometheus text format", Response: "", ResponseType: "text/plain"},
+	"/healthz":                                  {ID: "healthz", Tag: "monitoring", Summary: "Answer ok while the process is alive"},
+	"/readyz":                                   {ID: "readyz", Tag: "monitoring", Summary: "Check that consul answers and has a leader, 503 when it does not", Response: types.Readiness{}},
+	"/version":                                  {ID: "version", Tag: "monitoring", Summary: "Build metadata", Response: types.VersionInfo{}},
+	openAPIPath:                                 {ID: "openapi", Tag: "docs", Summary: "This document", Response: map[string]interface{}{}},
+	explorerPath:                                {ID: "explorer", Tag: "docs", Summary: "Page to explore and call the routes", Response: "", ResponseType: "text/html"},
+}
+
+// schemas generates the json schemas of Go types into components/schemas.
+type schemas map[string]interface{}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+func (s schemas) of(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == rawMessageType, t.Kind() == reflect.Interface:
+		return map[string]interface{}{}
+	case t.Kind() == reflect.Struct:
+		if _, ok := s[t.Name()]; !ok {
+			s[t.Name()] = nil // breaks cycles
+			s[t.Name()] = s.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return map[string]interface{}{"type": "array", "items": s.of(t.Elem())}
+	case t.Kind() == reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.of(t.Elem())}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+	return map[string]interface{}{"type": "string"}
+}
+
+// object follows the rules of encoding/json: the fields of embedded structs
+// are promoted, "-" fields are skipped and omitempty fields are optional.
+func (s schemas) object(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" || f.PkgPath != "" && !f.Anonymous {
+				continue
+			}
+			name, opts := tag, ""
+			if i := strings.Index(tag, ","); i >= 0 {
+				name, opts = tag[:i], tag[i:]
+			}
+			if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+				walk(f.Type)
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			properties[name] = s.of(f.Type)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+	}
+	walk(t)
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+func (s schemas) content(v interface{}, contentType string) map[string]interface{} {
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	return map[string]interface{}{contentType: map[string]interface{}{"schema": s.of(reflect.TypeOf(v))}}
+}
+
+var muxVar = regexp.MustCompile(`\{(\w+)(:[^}]*)?\}`)
+
+func (s schemas) operation(route string, doc routeDoc) map[string]interface{} {
+	if doc.Summary == "" {
+		doc.Summary = route
+	}
+	op := map[string]interface{}{"summary": doc.Summary}
+	if doc.ID != "" {
+		op["operationId"] = doc.ID
+	}
+	if doc.Tag != "" {
+		op["tags"] = []string{doc.Tag}
+	}
+
+	var params []interface{}
+	for _, m := range muxVar.FindAllStringSubmatch(route, -1) {
+		params = append(params, map[string]interface{}{"name": m[1], "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"}})
+	}
+	for _, name := range doc.Query {
+		p := map[string]interface{}{"name": name, "in": "query"}
+		for k, v := range queryParams[name] {
+			p[k] = v
+		}
+		params = append(params, p)
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	if doc.Request != nil {
+		op["requestBody"] = map[string]interface{}{"required": true, "content": s.content(doc.Request, doc.RequestType)}
+	}
+
+	ok := map[string]interface{}{"description": "success"}
+	switch {
+	case doc.Response != nil && doc.DryRun:
+		ok["description"] = "success, or the plan on dry_run"
+		ok["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": map[string]interface{}{
+			"oneOf": []interface{}{s.of(reflect.TypeOf(doc.Response)), s.of(reflect.TypeOf(types.ApplyReport{}))},
+		}}}
+	case doc.Response != nil:
+		ok["content"] = s.content(doc.Response, doc.ResponseType)
+	case doc.DryRun:
+		ok["description"] = `"ok", or the plan on dry_run`
+		content := s.content(types.ApplyReport{}, "")
+		content["text/plain"] = map[string]interface{}{"schema": map[string]interface{}{"type": "string", "enum": []string{"ok"}}}
+		ok["content"] = content
+	default:
+		ok["content"] = map[string]interface{}{"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string", "enum": []string{"ok"}}}}
+	}
+	op["responses"] = map[string]interface{}{
+		"200": ok,
+		"400": map[string]interface{}{"$ref": "#/components/responses/Error"},
+		"404": map[string]interface{}{"$ref": "#/components/responses/Error"},
+		"500": map[string]interface{}{"$ref": "#/components/responses/Error"},
+	}
+	return op
+}
+
+// OpenAPI returns the OpenAPI 3 document of routes, by method.
+func OpenAPI(version string, routes map[string]map[string]Handler) map[string]interface{} {
+	s := schemas{}
+	// the schemas the domain routes are built on, even when no route body
+	// refers to them directly
+	s.of(reflect.TypeOf(types.DomainCfg{}))
+	s.of(reflect.TypeOf(types.HealthCheckCfg{}))
+	s.of(reflect.TypeOf(types.CookieFilter{}))
+
+	paths := map[string]interface{}{}
+	for method, mappings := range routes {
+		for route := range mappings {
+			path := muxVar.ReplaceAllString(route, "{$1}")
+			item, ok := paths[path].(map[string]interface{})
+			if !ok {
+				item = map[string]interface{}{}
+				paths[path] = item
+			}
+			item[strings.ToLower(method)] = s.operation(route, routeDocs[route])
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "zlb api",
+			"description": "Manage the domains, servers and cookie filters stored in consul under zlb/. Errors are answered as a plain text message.",
+			"version":     version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": s,
+			"responses": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"description": "error message",
+					"content":     map[string]interface{}{"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}},
+				},
+			},
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+		// the token is only checked when the server is configured with one
+		"security": []interface{}{map[string]interface{}{}, map[string]interface{}{"bearerAuth": []string{}}},
+	}
+}
+
+func getOpenAPI(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	options, _ := ctx.Value(KEY_SERVER_OPTS).(opts.Options)
+	version := options.BuildVersion
+	if version == "" {
+		version = "dev"
+	}
+	// the routes come with the request, the routers literal this handler is
+	// part of can not refer to itself
+	routes, _ := ctx.Value(KEY_ROUTERS).(map[string]map[string]Handler)
+	writeJson(w, OpenAPI(version, routes))
+}
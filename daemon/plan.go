@@ -0,0 +1,261 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/zanecloud/zlb/api/types"
+)
+
+const (
+	// consul rejects transactions with more operations than this
+	txnMaxOps = 64
+
+	// serializes the plans larger than a transaction
+	applyLockKey  = "zlb-api/locks/apply"
+	applyLockWait = 30 * time.Second
+)
+
+// domainPairs returns the keys and values which represent d in the zlb/ tree.
+func domainPairs(d *types.Domain) map[string]string {
+	pairs := map[string]string{}
+	for _, p := range d.Paths {
+		if p.Cfg != nil {
+			cfg := *p.Cfg
+			cfg.Path = p.Path
+			jsonstr, _ := json.Marshal(&cfg)
+			pairs[cfgKey(d.Name, p.Path)] = string(jsonstr)
+		}
+		for _, s := range p.Servers {
+			pairs[serverKey(d.Name, p.Path, s)] = ""
+		}
+	}
+	for _, f := range d.CookieFilters {
+		pairs[ckfilterKey(d.Name, f.Name, f.Value)] = fmt.Sprintf("%d", f.Lifecycle)
+	}
+	return pairs
+}
+
+// sameValue compares two values, json documents are compared by content so
+// that a different field order or spacing is not reported as a change.
+func sameValue(a, b string) bool {
+	if a == b {
+		return true
+	}
+	var ja, jb interface{}
+	if json.Unmarshal([]byte(a), &ja) != nil || json.Unmarshal([]byte(b), &jb) != nil {
+		return false
+	}
+	ma, _ := json.Marshal(ja)
+	mb, _ := json.Marshal(jb)
+	return string(ma) == string(mb)
+}
+
+// planChanges compares the current pairs with the desired values. Keys which
+// are only in current are deleted when prune is not nil and returns true.
+func planChanges(current api.KVPairs, desired map[string]string, prune func(key string) bool) []*types.KVChange {
+	var changes []*types.KVChange
+	seen := map[string]bool{}
+	for _, pair := range current {
+		seen[pair.Key] = true
+		v, ok := desired[pair.Key]
+		switch {
+		case !ok && prune != nil && prune(pair.Key):
+			changes = append(changes, &types.KVChange{Op: "delete", Key: pair.Key, Old: string(pair.Value), Index: pair.ModifyIndex})
+		case ok && !sameValue(string(pair.Value), v):
+			changes = append(changes, &types.KVChange{Op: "set", Key: pair.Key, Old: string(pair.Value), New: v, Index: pair.ModifyIndex})
+		}
+	}
+	for k, v := range desired {
+		if !seen[k] {
+			changes = append(changes, &types.KVChange{Op: "set", Key: k, New: v})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+// planDomains plans the changes which write domains into the zlb/ tree,
+// current keys are deleted when prune is not nil and returns true for them.
+func planDomains(client *api.Client, domains []*types.Domain, prune func(key string) bool) ([]*types.KVChange, error) {
+	current, _, err := client.KV().List(zlbPrefix, &api.QueryOptions{RequireConsistent: true})
+	if err != nil {
+		return nil, err
+	}
+	desired := map[string]string{}
+	for _, d := range domains {
+		for k, v := range domainPairs(d) {
+			desired[k] = v
+		}
+	}
+	return planChanges(current, desired, prune), nil
+}
+
+// txnConflict is the error of a transaction consul rolled back, ops are the
+// indexes of the operations which failed.
+type txnConflict struct {
+	ops  []int
+	errs []string
+}
+
+func (e *txnConflict) Error() string {
+	return "transaction rolled back: " + strings.Join(e.errs, ", ")
+}
+
+// applyTxn writes changes with one transaction. It returns the changes which
+// undo it, conditioned on the ModifyIndex the transaction left.
+func applyTxn(client *api.Client, changes []*types.KVChange) ([]*types.KVChange, error) {
+	var ops api.KVTxnOps
+	for _, c := range changes {
+		op := &api.KVTxnOp{Key: c.Key, Index: c.Index}
+		if c.Op == "delete" {
+			op.Verb = api.KVDeleteCAS
+		} else {
+			op.Verb = api.KVCAS
+			op.Value = []byte(c.New)
+		}
+		ops = append(ops, op)
+	}
+	ok, resp, _, err := client.KV().Txn(ops, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		conflict := &txnConflict{}
+		for _, e := range resp.Errors {
+			conflict.ops = append(conflict.ops, e.OpIndex)
+			conflict.errs = append(conflict.errs, fmt.Sprintf("%s: %s", ops[e.OpIndex].Key, e.What))
+		}
+		return nil, conflict
+	}
+
+	indexes := map[string]uint64{}
+	for _, pair := range resp.Results {
+		indexes[pair.Key] = pair.ModifyIndex
+	}
+	undo := make([]*types.KVChange, 0, len(changes))
+	for _, c := range changes {
+		switch {
+		case c.Op == "delete":
+			undo = append(undo, &types.KVChange{Op: "set", Key: c.Key, New: c.Old})
+		case c.Index == 0:
+			undo = append(undo, &types.KVChange{Op: "delete", Key: c.Key, Index: indexes[c.Key]})
+		default:
+			undo = append(undo, &types.KVChange{Op: "set", Key: c.Key, New: c.Old, Index: indexes[c.Key]})
+		}
+	}
+	return undo, nil
+}
+
+// applyChanges writes changes with consul transactions. Every operation is
+// conditioned on the ModifyIndex seen when planning, so a key updated
+// concurrently makes the transaction roll back instead of being overwritten.
+//
+// A plan larger than a transaction is applied under the apply lock, one
+// transaction at a time. When one fails, or the lock is lost, the
+// transactions already applied are undone so that the tree is left as it was.
+// The undo is conditioned on the ModifyIndex of the apply too, a key changed
+// since by a writer which does not take the lock is left as that writer made
+// it and reported.
+//
+// The lock is taken with the client of KEY_LOCK_CLIENT in ctx when there is
+// one, its session is renewed and destroyed in the background, which a
+// request traced with client may not outlive.
+func applyChanges(ctx context.Context, client *api.Client, changes []*types.KVChange) error {
+	if len(changes) <= txnMaxOps {
+		_, err := applyTxn(client, changes)
+		return err
+	}
+
+	lockClient, ok := ctx.Value(KEY_LOCK_CLIENT).(*api.Client)
+	if !ok {
+		lockClient = client
+	}
+	lock, err := lockClient.LockOpts(&api.LockOptions{Key: applyLockKey, SessionName: "zlb-api apply"})
+	if err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	timer := time.AfterFunc(applyLockWait, func() { close(stop) })
+	lost, err := lock.Lock(stop)
+	timer.Stop()
+	if err != nil {
+		return err
+	}
+	if lost == nil {
+		return fmt.Errorf("another apply has held %s for more than %s", applyLockKey, applyLockWait)
+	}
+	defer lock.Unlock()
+
+	var undo []*types.KVChange
+	for start := 0; start < len(changes); start += txnMaxOps {
+		end := start + txnMaxOps
+		if end > len(changes) {
+			end = len(changes)
+		}
+		select {
+		case <-lost:
+			err = fmt.Errorf("lost %s", applyLockKey)
+		default:
+			var u []*types.KVChange
+			if u, err = applyTxn(client, changes[start:end]); err == nil {
+				undo = append(undo, u...)
+				continue
+			}
+		}
+		if rbErr := rollbackChanges(client, undo); rbErr != nil {
+			return fmt.Errorf("%s, %d of %d changes were applied and the rollback failed: %s", err.Error(), start, len(changes), rbErr.Error())
+		}
+		return fmt.Errorf("%s, the %d changes applied before were rolled back", err.Error(), start)
+	}
+	return nil
+}
+
+// rollbackChanges applies undo in the reverse order, as much of it as
+// possible: the transaction of the operations which conflict with a change
+// made since is applied again without them.
+func rollbackChanges(client *api.Client, undo []*types.KVChange) error {
+	var errs []string
+	for end := len(undo); end > 0; end -= txnMaxOps {
+		start := end - txnMaxOps
+		if start < 0 {
+			start = 0
+		}
+		changes := undo[start:end]
+		for len(changes) > 0 {
+			_, err := applyTxn(client, changes)
+			if err == nil {
+				break
+			}
+			errs = append(errs, err.Error())
+			conflict, ok := err.(*txnConflict)
+			if !ok {
+				break
+			}
+			failed := map[int]bool{}
+			for _, i := range conflict.ops {
+				failed[i] = true
+			}
+			var rest []*types.KVChange
+			for i, c := range changes {
+				if !failed[i] {
+					rest = append(rest, c)
+				}
+			}
+			if len(rest) == len(changes) {
+				break
+			}
+			changes = rest
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,439 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/zanecloud/zlb/api/types"
+)
+
+// fakeConsul serves the kv, txn and session endpoints of consul the planner
+// and the apply lock use. Every write bumps the index, which the cas
+// operations are checked against, and the blocking reads wait for.
+type fakeConsul struct {
+	mu       sync.Mutex
+	index    uint64
+	pairs    map[string]*api.KVPair
+	sessions int
+	txns     int
+
+	// beforeTxn runs, with mu held, before the transaction n counted from
+	// 1. The transaction fails when it returns true.
+	beforeTxn func(f *fakeConsul, n int) bool
+}
+
+func newFakeConsul(t *testing.T) (*fakeConsul, *api.Client, func()) {
+	f := &fakeConsul{index: 1, pairs: map[string]*api.KVPair{}}
+	srv := httptest.NewServer(f)
+	client, err := api.NewClient(&api.Config{Address: strings.TrimPrefix(srv.URL, "http://")})
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	return f, client, srv.Close
+}
+
+// put writes a pair, mu held.
+func (f *fakeConsul) put(key, value string, flags uint64) *api.KVPair {
+	f.index++
+	p, ok := f.pairs[key]
+	if !ok {
+		p = &api.KVPair{Key: key, CreateIndex: f.index}
+		f.pairs[key] = p
+	}
+	p.Value, p.Flags, p.ModifyIndex = []byte(value), flags, f.index
+	return p
+}
+
+func (f *fakeConsul) set(key, value string) {
+	f.mu.Lock()
+	f.put(key, value, 0)
+	f.mu.Unlock()
+}
+
+// values returns the values of the keys under prefix.
+func (f *fakeConsul) values(prefix string) map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	values := map[string]string{}
+	for k, p := range f.pairs {
+		if strings.HasPrefix(k, prefix) {
+			values[k] = string(p.Value)
+		}
+	}
+	return values
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		f.serveKV(w, r, strings.TrimPrefix(r.URL.Path, "/v1/kv/"))
+	case r.URL.Path == "/v1/txn":
+		f.serveTxn(w, r)
+	case r.URL.Path == "/v1/session/create":
+		f.mu.Lock()
+		f.sessions++
+		id := fmt.Sprintf("session-%d", f.sessions)
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"ID": id})
+	case strings.HasPrefix(r.URL.Path, "/v1/session/renew/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/session/renew/")
+		json.NewEncoder(w).Encode([]*api.SessionEntry{{ID: id}})
+	case strings.HasPrefix(r.URL.Path, "/v1/session/destroy/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/session/destroy/")
+		f.mu.Lock()
+		for _, p := range f.pairs {
+			if p.Session == id {
+				f.index++
+				p.Session, p.ModifyIndex = "", f.index
+			}
+		}
+		f.mu.Unlock()
+		w.Write([]byte("true"))
+	default:
+		http.Error(w, q.Encode(), http.StatusNotFound)
+	}
+}
+
+func (f *fakeConsul) serveKV(w http.ResponseWriter, r *http.Request, key string) {
+	q := r.URL.Query()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case "GET":
+		// a blocking read returns once the index moved, or after a while
+		wait, _ := strconv.ParseUint(q.Get("index"), 10, 64)
+		for deadline := time.Now().Add(100 * time.Millisecond); wait > 0 && f.index <= wait && time.Now().Before(deadline); {
+			f.mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			f.mu.Lock()
+		}
+		var pairs api.KVPairs
+		for k, p := range f.pairs {
+			if k == key || q["recurse"] != nil && strings.HasPrefix(k, key) {
+				pairs = append(pairs, p)
+			}
+		}
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+		if len(pairs) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		sort.Sort(pairsByKey(pairs))
+		json.NewEncoder(w).Encode(pairs)
+	case "PUT":
+		value, _ := ioutil.ReadAll(r.Body)
+		flags, _ := strconv.ParseUint(q.Get("flags"), 10, 64)
+		p := f.pairs[key]
+		switch {
+		case q.Get("acquire") != "":
+			if p != nil && p.Session != "" && p.Session != q.Get("acquire") {
+				w.Write([]byte("false"))
+				return
+			}
+			f.put(key, string(value), flags).Session = q.Get("acquire")
+		case q.Get("release") != "":
+			if p == nil || p.Session != q.Get("release") {
+				w.Write([]byte("false"))
+				return
+			}
+			f.put(key, string(value), flags).Session = ""
+		default:
+			f.put(key, string(value), flags)
+		}
+		w.Write([]byte("true"))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeConsul) serveTxn(w http.ResponseWriter, r *http.Request) {
+	var ops api.TxnOps
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.txns++
+
+	resp := &api.TxnResponse{}
+	if f.beforeTxn != nil && f.beforeTxn(f, f.txns) {
+		resp.Errors = append(resp.Errors, &api.TxnError{OpIndex: 0, What: "injected failure"})
+	}
+	for i, op := range ops {
+		p := f.pairs[op.KV.Key]
+		switch op.KV.Verb {
+		case api.KVCAS, api.KVDeleteCAS:
+			if op.KV.Index == 0 && p != nil || op.KV.Index != 0 && (p == nil || p.ModifyIndex != op.KV.Index) {
+				resp.Errors = append(resp.Errors, &api.TxnError{OpIndex: i, What: "index mismatch"})
+			}
+		default:
+			resp.Errors = append(resp.Errors, &api.TxnError{OpIndex: i, What: "unexpected verb " + string(op.KV.Verb)})
+		}
+	}
+	if len(resp.Errors) > 0 {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	for _, op := range ops {
+		if op.KV.Verb == api.KVDeleteCAS {
+			f.index++
+			delete(f.pairs, op.KV.Key)
+			continue
+		}
+		p := *f.put(op.KV.Key, string(op.KV.Value), 0)
+		p.Value = nil
+		resp.Results = append(resp.Results, &api.TxnResult{KV: &p})
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func TestParseDesiredStateInvalid(t *testing.T) {
+	for _, c := range []struct{ doc, err string }{
+		{"domains:\n- name: a.com\n  paths:\n  - path: api\n", "invalid Path"},
+		{"domains:\n- name: a.com\n  paths:\n  - path: \"/a b\"\n", "invalid Path"},
+		{"domains:\n- name: a.com\n  paths:\n  - path: \"/a;\"\n", "invalid Path"},
+		{"domains:\n- name: a.com\n  paths:\n  - path: /\n  - path: /\n", "declared twice"},
+		{"domains:\n- name: a.com\n  paths:\n  - path: /\n    servers: [10.0.0.1]\n", "invalid server"},
+		{"domains:\n- name: a/b\n", "invalid domain name"},
+		{"domains:\n- name: a.com\n  cookieFilters:\n  - name: uid\n", "Value must not be empty"},
+		{"domains:\n- name: a.com\n  cookieFilters:\n  - name: u/id\n    value: \"1\"\n", "invalid Name"},
+		{"domains:\n- name: a.com\n  cookieFilters:\n  - name: uid\n    value: 1/2\n", "invalid Value"},
+		{"domains:\n- name: a.com\n  cookieFilters:\n  - name: uid\n    value: \"a b\"\n", "invalid Value"},
+		{`{"Domains":[{"Name":"a.com","Paths":[{"Path":"/","Unknown":1}]}]}`, "Unknown"},
+	} {
+		if _, err := ParseDesiredState([]byte(c.doc)); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: got error %v, want %q", c.doc, err, c.err)
+		}
+	}
+}
+
+func TestPlanApply(t *testing.T) {
+	f, client, stop := newFakeConsul(t)
+	defer stop()
+	f.set(cfgKey("a.com", "/"), `{"Path":"/","Healthcheck":{"Type":"tcp"}}`)
+	f.set(serverKey("a.com", "/", "10.0.0.1:80"), "")
+	f.set(serverKey("a.com", "/", "10.0.0.2:80"), "")
+	f.set(ckfilterKey("a.com", "uid", "42"), "0")
+	f.set(cfgKey("b.com", "/"), `{"Path":"/"}`)
+
+	domains, err := ParseDesiredState([]byte(`
+domains:
+- name: a.com
+  paths:
+  - path: /
+    healthcheck: {type: tcp}
+    servers: [10.0.0.2:80, 10.0.0.3:80]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type op struct{ op, key string }
+	ops := func(changes []*types.KVChange) []op {
+		var got []op
+		for _, c := range changes {
+			got = append(got, op{c.Op, c.Key})
+			if c.Op == "delete" && c.Index == 0 {
+				t.Errorf("the delete of %s is not conditioned on its index", c.Key)
+			}
+		}
+		return got
+	}
+
+	// the cfg differs only by the order of its fields
+	changes, err := PlanApply(client, domains, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []op{
+		{"delete", ckfilterKey("a.com", "uid", "42")},
+		{"delete", serverKey("a.com", "/", "10.0.0.1:80")},
+		{"set", serverKey("a.com", "/", "10.0.0.3:80")},
+	}
+	if got := ops(changes); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	changes, err = PlanApply(client, domains, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append([]op{{"delete", cfgKey("b.com", "/")}}, want...)
+	sort.Slice(want, func(i, j int) bool { return want[i].key < want[j].key })
+	if got := ops(changes); !reflect.DeepEqual(got, want) {
+		t.Errorf("with prune, got %v, want %v", got, want)
+	}
+}
+
+// testChanges plans n servers of a.com over the tree, which has the servers
+// of 0 to n/2 and of n to n+n/2: the first half are left as they are, the
+// second set and the last deleted.
+func testChanges(t *testing.T, f *fakeConsul, client *api.Client, n int) ([]*types.KVChange, map[string]string) {
+	for i := 0; i < n/2; i++ {
+		f.set(serverKey("a.com", "/", fmt.Sprintf("10.0.0.%d:80", i)), "")
+		f.set(serverKey("a.com", "/", fmt.Sprintf("10.0.1.%d:80", i)), "")
+	}
+	d := &types.Domain{Name: "a.com"}
+	p := d.EnsurePath("/")
+	for i := 0; i < n; i++ {
+		p.Servers = append(p.Servers, fmt.Sprintf("10.0.0.%d:80", i))
+	}
+	changes, err := planDomains(client, []*types.Domain{d}, func(string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != n {
+		t.Fatalf("got %d changes, want %d", len(changes), n)
+	}
+	return changes, domainPairs(d)
+}
+
+func TestApplyChangesSmall(t *testing.T) {
+	f, client, stop := newFakeConsul(t)
+	defer stop()
+	changes, want := testChanges(t, f, client, txnMaxOps)
+
+	if err := applyChanges(context.Background(), client, changes); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.values(zlbPrefix); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if f.txns != 1 || f.sessions != 0 {
+		t.Errorf("got %d transactions and %d sessions, want one transaction without the lock", f.txns, f.sessions)
+	}
+}
+
+func TestApplyChangesSplit(t *testing.T) {
+	f, client, stop := newFakeConsul(t)
+	defer stop()
+	changes, want := testChanges(t, f, client, 2*txnMaxOps+10)
+
+	held := 0
+	f.beforeTxn = func(f *fakeConsul, n int) bool {
+		if p := f.pairs[applyLockKey]; p != nil && p.Session != "" {
+			held++
+		}
+		return false
+	}
+	if err := applyChanges(context.Background(), client, changes); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.values(zlbPrefix); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if f.txns != 3 || held != 3 {
+		t.Errorf("got %d transactions, %d under the lock, want 3 under the lock", f.txns, held)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if p := f.pairs[applyLockKey]; p == nil || p.Session != "" {
+		t.Errorf("the lock is not released: %+v", p)
+	}
+}
+
+// the lock client of the context takes the lock, the changes are written
+// with the client given.
+func TestApplyChangesLockClient(t *testing.T) {
+	f, client, stop := newFakeConsul(t)
+	defer stop()
+	lf, lockClient, stopLock := newFakeConsul(t)
+	defer stopLock()
+	changes, want := testChanges(t, f, client, 2*txnMaxOps)
+
+	ctx := context.WithValue(context.Background(), KEY_LOCK_CLIENT, lockClient)
+	if err := applyChanges(ctx, client, changes); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.values(zlbPrefix); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if f.sessions != 0 || lf.sessions != 1 || lf.txns != 0 {
+		t.Errorf("got %d sessions of the client, %d and %d transactions of the lock client, want the lock only on the lock client", f.sessions, lf.sessions, lf.txns)
+	}
+}
+
+func TestApplyChangesRollback(t *testing.T) {
+	f, client, stop := newFakeConsul(t)
+	defer stop()
+	changes, _ := testChanges(t, f, client, 2*txnMaxOps+10)
+	before := f.values(zlbPrefix)
+
+	f.beforeTxn = func(f *fakeConsul, n int) bool { return n == 3 }
+	err := applyChanges(context.Background(), client, changes)
+	if err == nil || !strings.Contains(err.Error(), "injected failure") || !strings.Contains(err.Error(), "the 128 changes applied before were rolled back") {
+		t.Fatalf("got error %v, want the failure of the third transaction rolled back", err)
+	}
+	if got := f.values(zlbPrefix); !reflect.DeepEqual(got, before) {
+		t.Errorf("got %v, want the tree before the apply %v", got, before)
+	}
+}
+
+// a key changed by another writer during the apply is left as it made it,
+// the rest of the transaction it is undone in is rolled back.
+func TestApplyChangesRollbackConflict(t *testing.T) {
+	f, client, stop := newFakeConsul(t)
+	defer stop()
+	changes, _ := testChanges(t, f, client, 2*txnMaxOps+10)
+	before := f.values(zlbPrefix)
+
+	changed := changes[0].Key
+	f.beforeTxn = func(f *fakeConsul, n int) bool {
+		if n == 2 {
+			f.put(changed, "other writer", 0)
+		}
+		return n == 3
+	}
+	err := applyChanges(context.Background(), client, changes)
+	if err == nil || !strings.Contains(err.Error(), "the rollback failed") || !strings.Contains(err.Error(), changed) {
+		t.Fatalf("got error %v, want the rollback of %s failed", err, changed)
+	}
+	want := map[string]string{}
+	for k, v := range before {
+		want[k] = v
+	}
+	want[changed] = "other writer"
+	if got := f.values(zlbPrefix); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// a key changed since the plan makes the transaction roll back instead of
+// being overwritten.
+func TestApplyChangesStalePlan(t *testing.T) {
+	f, client, stop := newFakeConsul(t)
+	defer stop()
+	changes, _ := testChanges(t, f, client, 10)
+	var stale string
+	for _, c := range changes {
+		if c.Op == "delete" {
+			stale = c.Key
+			break
+		}
+	}
+	f.set(stale, "changed")
+	before := f.values(zlbPrefix)
+
+	if err := applyChanges(context.Background(), client, changes); err == nil || !strings.Contains(err.Error(), stale) {
+		t.Fatalf("got error %v, want the conflict on %s", err, stale)
+	}
+	if got := f.values(zlbPrefix); !reflect.DeepEqual(got, before) {
+		t.Errorf("got %v, want %v", got, before)
+	}
+}
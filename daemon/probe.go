@@ -0,0 +1,80 @@
+package daemon
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/zanecloud/zlb/api/probe"
+	"github.com/zanecloud/zlb/api/types"
+)
+
+// newCheck returns the health check of a domain path with the defaults of
+// the data plane, nil when the path has none.
+func newCheck(domain string, hc *types.HealthCheckCfg) *probe.Check {
+	if hc.Type == "" {
+		return nil
+	}
+	return &probe.Check{
+		Type:          hc.Type,
+		Host:          domain,
+		Uri:           hc.Uri,
+		ValidStatuses: validStatuses(hc),
+		Timeout:       time.Duration(orDefault(hc.Timeout, defaultTimeout)) * time.Millisecond,
+		Sni:           hc.Sni,
+		SkipVerify:    hc.Skip_verify,
+		Tls:           hc.Tls,
+		GrpcService:   hc.Grpc_service,
+		MysqlUser:     hc.Mysql_user,
+	}
+}
+
+// probeDomain runs the health checks of the paths of a domain, or of the
+// path given by ?path=, against their servers now. The exec checks are
+// skipped.
+func probeDomain(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	pairs, _, err := readTree(ctx, r, zlbPrefix+name+"/")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	domains, err := ParseDomains(pairs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(domains) == 0 {
+		http.Error(w, "No such domain", http.StatusNotFound)
+		return
+	}
+	paths := domains[0].SortedPaths()
+	if path := r.URL.Query().Get("path"); path != "" {
+		p, ok := domains[0].Paths[path]
+		if !ok {
+			http.Error(w, "No such path", http.StatusNotFound)
+			return
+		}
+		paths = []*types.DomainPath{p}
+	}
+
+	probes := []*types.PathProbe{}
+	for _, p := range paths {
+		cfg := pathCfg(p)
+		pp := &types.PathProbe{Path: p.Path, Type: cfg.Healthcheck.Type, Results: []*types.ProbeResult{}}
+		probes = append(probes, pp)
+		check := newCheck(name, &cfg.Healthcheck)
+		switch {
+		case check == nil:
+			pp.Skipped = "no health check"
+		case check.Type == "exec":
+			pp.Skipped = "exec checks only run on the LB nodes"
+		case len(p.Servers) == 0:
+			pp.Skipped = "no servers"
+		default:
+			pp.Results = probe.Run(r.Context(), check, p.Servers, orDefault(cfg.Healthcheck.Concurrency, defaultConcurrency))
+		}
+	}
+	writeJson(w, probes)
+}
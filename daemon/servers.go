@@ -0,0 +1,157 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/consul/api"
+	"github.com/zanecloud/zlb/api/types"
+)
+
+// commitRequest applies the plan of a mutating request, or only returns it
+// on a dry run.
+func commitRequest(ctx context.Context, w http.ResponseWriter, r *http.Request, client *api.Client, set map[string]string, del []string) {
+	if isDryRun(r) {
+		writeDryRun(w, client, set, del)
+		return
+	}
+	changes, err := planRequest(client, set, del)
+	if err == nil {
+		err = applyChanges(ctx, client, changes)
+	}
+	if err != nil {
+		logger(r.Context()).WithFields(logrus.Fields{"uri": r.RequestURI}).Infof("write consule fail :%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+func decodeServerList(w http.ResponseWriter, r *http.Request) (string, *types.ServerList, bool) {
+	domainName := mux.Vars(r)["name"]
+	if domainName == "" {
+		http.Error(w, "Please set DomainName in URI ", 404)
+		return "", nil, false
+	}
+	req := &types.ServerList{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", nil, false
+	}
+	if len(req.Servers) == 0 {
+		http.Error(w, "Please set Servers", http.StatusBadRequest)
+		return "", nil, false
+	}
+	if req.Path != "" {
+		if err := types.ValidatePath(req.Path); err != nil {
+			http.Error(w, fmt.Sprintf("invalid Path %q, %s", req.Path, err.Error()), http.StatusBadRequest)
+			return "", nil, false
+		}
+	}
+	for _, s := range req.Servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			http.Error(w, fmt.Sprintf("invalid server %q, expecting host:port", s), http.StatusBadRequest)
+			return "", nil, false
+		}
+	}
+	return domainName, req, true
+}
+
+// checkNotSynced answers 409 when the servers of the path are synced by the
+// discovery, which would undo a manual change.
+func checkNotSynced(w http.ResponseWriter, client *api.Client, domain, path string) bool {
+	pair, _, err := client.KV().Get(cfgKey(domain, path), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if pair == nil {
+		return true
+	}
+	cfg := &types.DomainCfg{}
+	if json.Unmarshal(pair.Value, cfg) == nil && cfg.Synced() {
+		var source string
+		if cfg.Service != nil {
+			source = "the consul service " + cfg.Service.Name
+		} else {
+			source = "the dns name " + cfg.DNS.Name
+		}
+		http.Error(w, "the servers of this path are synced from "+source, http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+func addServers(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	client, _ := ctx.Value(KEY_CONSUL_CLIENT).(*api.Client)
+	domainName, req, ok := decodeServerList(w, r)
+	if !ok || !checkNotSynced(w, client, domainName, req.Path) {
+		return
+	}
+	set := map[string]string{}
+	for _, s := range req.Servers {
+		set[serverKey(domainName, req.Path, s)] = ""
+	}
+	commitRequest(ctx, w, r, client, set, nil)
+}
+
+func removeServers(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	client, _ := ctx.Value(KEY_CONSUL_CLIENT).(*api.Client)
+	domainName, req, ok := decodeServerList(w, r)
+	if !ok || !checkNotSynced(w, client, domainName, req.Path) {
+		return
+	}
+	var del []string
+	for _, s := range req.Servers {
+		del = append(del, serverKey(domainName, req.Path, s))
+	}
+	commitRequest(ctx, w, r, client, nil, del)
+}
+
+func getCookieFilterList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	pairs, index, err := readTree(ctx, r, zlbPrefix+name+"/ckfilter/")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	domains, err := ParseDomains(pairs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	filters := []*types.CookieFilter{}
+	if len(domains) > 0 {
+		filters = domains[0].CookieFilters
+	}
+	setIndexHeader(w, index)
+	writeJson(w, filters)
+}
+
+// deleteCookieFilter removes the filter on one value of a cookie, or on all
+// its values when Value is empty.
+func deleteCookieFilter(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	client, _ := ctx.Value(KEY_CONSUL_CLIENT).(*api.Client)
+	domainName := mux.Vars(r)["name"]
+	if domainName == "" {
+		http.Error(w, "Please set DomainName in URI ", 404)
+		return
+	}
+	req := &types.CookieFilter{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "Please set Name", http.StatusBadRequest)
+		return
+	}
+	consulkey := ckfilterKey(domainName, req.Name, req.Value)
+	commitRequest(ctx, w, r, client, nil, []string{consulkey})
+}
@@ -0,0 +1,246 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/consul/api"
+	"github.com/zanecloud/zlb/api/types"
+)
+
+// the catalog lookups of the services listing runs at once
+const serviceLookups = 8
+
+func catalogService(s *api.CatalogService) *types.Service {
+	tags := s.ServiceTags
+	if tags == nil {
+		tags = []string{}
+	}
+	return &types.Service{
+		ID:                s.ServiceID,
+		Node:              s.Node,
+		Name:              s.ServiceName,
+		Tags:              tags,
+		Address:           s.ServiceAddress,
+		Port:              s.ServicePort,
+		EnableTagOverride: s.ServiceEnableTagOverride,
+	}
+}
+
+type servicesByID []*types.Service
+
+func (s servicesByID) Len() int      { return len(s) }
+func (s servicesByID) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s servicesByID) Less(i, j int) bool {
+	if s[i].ID != s[j].ID {
+		return s[i].ID < s[j].ID
+	}
+	return s[i].Node < s[j].Node
+}
+
+// catalogInstances returns the instances of the named service in the catalog.
+func catalogInstances(client *api.Client, name string) ([]*types.Service, error) {
+	instances, _, err := client.Catalog().Service(name, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*types.Service, 0, len(instances))
+	for _, s := range instances {
+		list = append(list, catalogService(s))
+	}
+	return list, nil
+}
+
+// listServices returns the instances of the services of the catalog, of all
+// the agents of the datacenter, sorted by ID and node. The consul servers
+// are left out. The catalog lists the instances by name only, the names are
+// looked up serviceLookups at a time.
+func listServices(client *api.Client) ([]*types.Service, error) {
+	names, _, err := client.Catalog().Services(nil)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	list := []*types.Service{}
+	sem := make(chan struct{}, serviceLookups)
+	for name := range names {
+		if name == "consul" {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(name string) {
+			defer func() { <-sem; wg.Done() }()
+			instances, err := catalogInstances(client, name)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			list = append(list, instances...)
+		}(name)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	sort.Sort(servicesByID(list))
+	return list, nil
+}
+
+// getService returns the instance of the catalog with the ID on node, or on
+// the first node which has one when node is empty. The ID is looked up as a
+// name, then as the ID of a service of the agent zlb-api talks to, whose
+// name is looked up. The instances of another agent whose ID is not their
+// name are only in the listing.
+func getService(client *api.Client, id, node string) (*types.Service, error) {
+	if id == "consul" {
+		return nil, nil
+	}
+	find := func(name string) (*types.Service, error) {
+		instances, err := catalogInstances(client, name)
+		if err != nil {
+			return nil, err
+		}
+		sort.Sort(servicesByID(instances))
+		for _, s := range instances {
+			if s.ID == id && (node == "" || s.Node == node) {
+				return s, nil
+			}
+		}
+		return nil, nil
+	}
+	if s, err := find(id); s != nil || err != nil {
+		return s, err
+	}
+	services, err := client.Agent().Services()
+	if err != nil {
+		return nil, err
+	}
+	if agent, ok := services[id]; ok && agent.Service != id {
+		return find(agent.Service)
+	}
+	return nil, nil
+}
+
+// hasAgentService reports whether the agent zlb-api talks to has the service,
+// the only ones it can deregister.
+func hasAgentService(client *api.Client, id string) (bool, error) {
+	services, err := client.Agent().Services()
+	if err != nil {
+		return false, err
+	}
+	_, ok := services[id]
+	return ok && id != "consul", nil
+}
+
+func getServiceList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	client, _ := ctx.Value(KEY_CONSUL_CLIENT).(*api.Client)
+	services, err := listServices(client)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, services)
+}
+
+func getServiceJson(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	client, _ := ctx.Value(KEY_CONSUL_CLIENT).(*api.Client)
+	s, err := getService(client, mux.Vars(r)["id"], r.URL.Query().Get("node"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if s == nil {
+		http.Error(w, "No such service", http.StatusNotFound)
+		return
+	}
+	writeJson(w, s)
+}
+
+func registerService(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	client, _ := ctx.Value(KEY_CONSUL_CLIENT).(*api.Client)
+	req := &types.Service{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.ID == "" {
+		req.ID = req.Name
+	}
+	if req.Tags == nil {
+		req.Tags = []string{}
+	}
+
+	// the agent has nothing to plan, a dry run only validates the service
+	if isDryRun(r) {
+		writeJson(w, req)
+		return
+	}
+
+	reg := &api.AgentServiceRegistration{
+		ID:                req.ID,
+		Name:              req.Name,
+		Tags:              req.Tags,
+		Address:           req.Address,
+		Port:              req.Port,
+		EnableTagOverride: req.EnableTagOverride,
+	}
+	for _, c := range req.Checks {
+		reg.Checks = append(reg.Checks, &api.AgentServiceCheck{
+			HTTP:                           c.HTTP,
+			Method:                         c.Method,
+			TLSSkipVerify:                  c.TLSSkipVerify,
+			TCP:                            c.TCP,
+			TTL:                            c.TTL,
+			Interval:                       c.Interval,
+			Timeout:                        c.Timeout,
+			DeregisterCriticalServiceAfter: c.DeregisterCriticalServiceAfter,
+		})
+	}
+	if err := client.Agent().ServiceRegister(reg); err != nil {
+		logger(ctx).WithFields(logrus.Fields{"service": req.ID}).Infof("register service fail :%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, req)
+}
+
+func deregisterService(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	client, _ := ctx.Value(KEY_CONSUL_CLIENT).(*api.Client)
+	id := mux.Vars(r)["id"]
+	ok, err := hasAgentService(client, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "No such service", http.StatusNotFound)
+		return
+	}
+	if !isDryRun(r) {
+		if err := client.Agent().ServiceDeregister(id); err != nil {
+			logger(ctx).WithFields(logrus.Fields{"service": id}).Infof("deregister service fail :%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
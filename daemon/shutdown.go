@@ -0,0 +1,98 @@
+package daemon
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/zanecloud/zlb/api/opts"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+// serve runs srv until SIGINT or SIGTERM. It then stops accepting
+// connections, drains the requests in flight, cancels the background
+// workers with stop and waits for them with wait, all within
+// opts.ShutdownTimeout. SIGHUP reloads the options.
+func serve(srv *http.Server, opts opts.Options, stop context.CancelFunc, wait func()) {
+	errc := make(chan error, 1)
+	go func() {
+		if opts.TLSCert != "" {
+			errc <- srv.ListenAndServeTLS(opts.TLSCert, opts.TLSKey)
+			return
+		}
+		errc <- srv.ListenAndServe()
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+
+	for {
+		select {
+		case err := <-errc:
+			logrus.Errorf("run zlb api err:%s", err.Error())
+			stop()
+			return
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				reload(opts)
+				continue
+			}
+			shutdown(srv, opts, sig, stop, wait)
+			return
+		}
+	}
+}
+
+func shutdown(srv *http.Server, opts opts.Options, sig os.Signal, stop context.CancelFunc, wait func()) {
+	timeout := opts.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	logrus.WithFields(logrus.Fields{"signal": sig.String(), "timeout": timeout.String()}).Info("shutting down zlb api")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logrus.Errorf("drain requests fail :%s", err.Error())
+	}
+
+	stop()
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		logrus.Info("zlb api stopped")
+	case <-ctx.Done():
+		logrus.Warn("background workers did not stop before the shutdown timeout")
+	}
+}
+
+func reload(opts opts.Options) {
+	if opts.Reload == nil {
+		logrus.Info("received SIGHUP, no config file to reload")
+		return
+	}
+	newOpts, err := opts.Reload()
+	if err != nil {
+		logrus.Errorf("reload config fail :%s", err.Error())
+		return
+	}
+	if newOpts.Loglevel != "" {
+		level, err := logrus.ParseLevel(newOpts.Loglevel)
+		if err != nil {
+			logrus.Errorf("reload config fail :%s", err.Error())
+			return
+		}
+		logrus.SetLevel(level)
+	}
+	logrus.WithFields(logrus.Fields{"loglevel": logrus.GetLevel().String()}).Info("config reloaded")
+}
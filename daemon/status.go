@@ -0,0 +1,188 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/consul/api"
+	"github.com/zanecloud/zlb/api/types"
+)
+
+const (
+	statusPrefix = "zlb-api/status/"
+
+	// a node which has not reported for this long is flagged as stale
+	statusStaleAfter = 2 * time.Minute
+)
+
+func backendKey(domain, path, server string) string {
+	return domain + " " + path + " " + server
+}
+
+func listNodeStatus(client *api.Client, q *api.QueryOptions) ([]*types.NodeStatus, error) {
+	pairs, _, err := client.KV().List(statusPrefix, q)
+	if err != nil {
+		return nil, err
+	}
+	stale := time.Now().Add(-statusStaleAfter).Unix()
+	nodes := make([]*types.NodeStatus, 0, len(pairs))
+	for _, pair := range pairs {
+		s := &types.NodeStatus{}
+		if err := json.Unmarshal(pair.Value, s); err != nil {
+			logrus.WithFields(logrus.Fields{"consulkey": pair.Key}).Warnf("invalid node status :%s", err.Error())
+			continue
+		}
+		s.Stale = s.Time < stale
+		nodes = append(nodes, s)
+	}
+	return nodes, nil
+}
+
+// reportStatus stores the report of an LB node. The Since of a backend which
+// the node did not set is the time its state changed according to the
+// reports of the node.
+func reportStatus(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	client, _ := ctx.Value(KEY_CONSUL_CLIENT).(*api.Client)
+	req := &types.NodeStatus{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	consulkey := statusPrefix + req.Node
+	pair, _, err := client.KV().Get(consulkey, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	previous := map[string]*types.BackendStatus{}
+	if pair != nil {
+		old := &types.NodeStatus{}
+		if json.Unmarshal(pair.Value, old) == nil {
+			for _, b := range old.Backends {
+				previous[backendKey(b.Domain, b.Path, b.Server)] = b
+			}
+		}
+	}
+
+	now := time.Now().Unix()
+	for _, b := range req.Backends {
+		if b.Path == "" {
+			b.Path = "/"
+		}
+		if b.Since != 0 {
+			continue
+		}
+		if old, ok := previous[backendKey(b.Domain, b.Path, b.Server)]; ok && old.Up == b.Up {
+			b.Since = old.Since
+		} else {
+			b.Since = now
+		}
+	}
+	req.Time = now
+	req.Stale = false
+
+	jsonstr, _ := json.Marshal(req)
+	if isDryRun(r) {
+		writeDryRun(w, client, map[string]string{consulkey: string(jsonstr)}, nil)
+		return
+	}
+	if _, err := client.KV().Put(&api.KVPair{Key: consulkey, Value: jsonstr}, nil); err != nil {
+		logger(ctx).WithFields(logrus.Fields{"consulkey": consulkey}).Infof("put consule fail :%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+func getNodeStatusList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	client, _ := ctx.Value(KEY_CONSUL_CLIENT).(*api.Client)
+	nodes, err := listNodeStatus(client, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, nodes)
+}
+
+// getDomainHealth merges the reports of the nodes about the servers of a
+// domain. Servers which are reported but no longer configured are left out.
+func getDomainHealth(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	client, _ := ctx.Value(KEY_CONSUL_CLIENT).(*api.Client)
+	name := mux.Vars(r)["name"]
+	pairs, index, err := readTree(ctx, r, zlbPrefix+name+"/")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	domains, err := ParseDomains(pairs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(domains) == 0 {
+		http.Error(w, "No such domain", http.StatusNotFound)
+		return
+	}
+	nodes, err := listNodeStatus(client, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	health := &types.DomainHealth{Domain: name, Paths: []*types.PathHealth{}}
+	servers := map[string]*types.ServerHealth{}
+	for _, p := range domains[0].SortedPaths() {
+		ph := &types.PathHealth{Path: p.Path, Servers: []*types.ServerHealth{}}
+		for _, s := range p.Servers {
+			sh := &types.ServerHealth{Server: s, Up: []string{}, Down: []*types.NodeDown{}}
+			servers[backendKey(name, p.Path, s)] = sh
+			ph.Servers = append(ph.Servers, sh)
+		}
+		health.Paths = append(health.Paths, ph)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Node < nodes[j].Node })
+	for _, n := range nodes {
+		for _, b := range n.Backends {
+			sh, ok := servers[backendKey(b.Domain, b.Path, b.Server)]
+			if !ok {
+				continue
+			}
+			// a stale up is no evidence the server is still up
+			if b.Up && !n.Stale {
+				sh.Up = append(sh.Up, n.Node)
+			} else if !b.Up {
+				sh.Down = append(sh.Down, &types.NodeDown{Node: n.Node, Since: b.Since, LastError: b.LastError, Stale: n.Stale})
+			}
+		}
+	}
+	setIndexHeader(w, index)
+	writeJson(w, health)
+}
+
+// removeNodeStatus forgets a decommissioned LB node.
+func removeNodeStatus(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	client, _ := ctx.Value(KEY_CONSUL_CLIENT).(*api.Client)
+	consulkey := statusPrefix + mux.Vars(r)["node"]
+	if isDryRun(r) {
+		writeDryRun(w, client, nil, []string{consulkey})
+		return
+	}
+	if _, err := client.KV().Delete(consulkey, nil); err != nil {
+		logger(ctx).WithFields(logrus.Fields{"consulkey": consulkey}).Infof("delete consule fail :%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
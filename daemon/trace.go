@@ -0,0 +1,282 @@
+package daemon
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+	"github.com/zanecloud/zlb/api/opts"
+)
+
+const KEY_TRACE_SPAN = "trace.span"
+
+const (
+	traceparentHeader = "traceparent"
+	tracestateHeader  = "tracestate"
+
+	// the kinds of the OTLP protocol
+	spanKindServer = 2
+	spanKindClient = 3
+
+	// the error status code of the OTLP protocol, a span is unset otherwise
+	spanStatusError = 2
+
+	traceQueueSize     = 2048
+	traceBatchSize     = 256
+	traceFlushInterval = 5 * time.Second
+)
+
+// version 00 of https://www.w3.org/TR/trace-context/#traceparent-header
+var validTraceparent = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// span is a finished or ongoing operation of a trace, its ids are hex
+// encoded as in the traceparent header and the OTLP JSON encoding.
+type span struct {
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	TraceState string
+	Sampled    bool
+	Name       string
+	Kind       int
+	Start      time.Time
+	End        time.Time
+	Status     int
+	Message    string
+
+	mu    sync.Mutex
+	attrs map[string]interface{}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// spanOf returns the span ctx belongs to, or nil.
+func spanOf(ctx context.Context) *span {
+	sp, _ := ctx.Value(KEY_TRACE_SPAN).(*span)
+	return sp
+}
+
+// SetAttr records an attribute of the span, v is a string, a bool or a
+// number.
+func (s *span) SetAttr(k string, v interface{}) {
+	s.mu.Lock()
+	s.attrs[k] = v
+	s.mu.Unlock()
+}
+
+func (s *span) SetError(msg string) {
+	s.mu.Lock()
+	s.Status = spanStatusError
+	s.Message = msg
+	s.mu.Unlock()
+}
+
+// Traceparent returns the traceparent header which makes s the parent of the
+// spans of the receiver.
+func (s *span) Traceparent() string {
+	flags := "00"
+	if s.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", s.TraceID, s.SpanID, flags)
+}
+
+// tracer starts the spans and exports the sampled ones in batches from its
+// Run loop. A nil tracer starts no span.
+type tracer struct {
+	exporter spanExporter
+	queue    chan *span
+}
+
+// newTracer returns the tracer configured by opts, nil when tracing is off.
+func newTracer(opts opts.Options) (*tracer, error) {
+	var exporter spanExporter
+	switch opts.TraceExporter {
+	case "", "none":
+		return nil, nil
+	case "otlp":
+		exporter = newOtlpExporter(opts.TraceEndpoint)
+	case "file":
+		e, err := newFileExporter(opts.TraceEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		exporter = e
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", opts.TraceExporter)
+	}
+	return &tracer{exporter: exporter, queue: make(chan *span, traceQueueSize)}, nil
+}
+
+// start begins a span whose parent is the span of ctx, or the remote span of
+// traceparent when ctx has none. The span is a root of a new trace when
+// neither is valid.
+func (t *tracer) start(ctx context.Context, name string, kind int, traceparent, tracestate string) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+	sp := &span{
+		SpanID:  randomHex(8),
+		Name:    name,
+		Kind:    kind,
+		Start:   time.Now(),
+		Sampled: true,
+		attrs:   map[string]interface{}{},
+	}
+	if parent := spanOf(ctx); parent != nil {
+		sp.TraceID = parent.TraceID
+		sp.ParentID = parent.SpanID
+		sp.TraceState = parent.TraceState
+		sp.Sampled = parent.Sampled
+	} else if m := validTraceparent.FindStringSubmatch(traceparent); m != nil && m[1] != "00000000000000000000000000000000" && m[2] != "0000000000000000" {
+		flags, _ := strconv.ParseUint(m[3], 16, 8)
+		sp.TraceID = m[1]
+		sp.ParentID = m[2]
+		sp.TraceState = tracestate
+		sp.Sampled = flags&1 == 1
+	} else {
+		sp.TraceID = randomHex(16)
+	}
+	return context.WithValue(ctx, KEY_TRACE_SPAN, sp), sp
+}
+
+// finish ends sp and queues it for the export when it is sampled, the span
+// is dropped when the queue is full rather than slowing the request down.
+func (t *tracer) finish(sp *span) {
+	if t == nil || sp == nil {
+		return
+	}
+	sp.End = time.Now()
+	if !sp.Sampled {
+		return
+	}
+	select {
+	case t.queue <- sp:
+	default:
+		spansDropped.Inc()
+	}
+}
+
+// Run exports the queued spans until ctx is cancelled, it then exports the
+// spans left in the queue.
+func (t *tracer) Run(ctx context.Context) {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(batch); err != nil {
+			logrus.WithFields(logrus.Fields{"spans": len(batch)}).Warnf("export spans fail :%s", err.Error())
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case sp := <-t.queue:
+			if batch = append(batch, sp); len(batch) >= traceBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			for {
+				select {
+				case sp := <-t.queue:
+					batch = append(batch, sp)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// traceTransport runs the consul requests of an HTTP request in child spans
+// of the span of ctx, and propagates the trace to consul. ctx is set once
+// when the transport is built, the requests of a transport without one are
+// not traced.
+type traceTransport struct {
+	ctx    context.Context
+	tracer *tracer
+	next   http.RoundTripper
+}
+
+func (t *traceTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if t.ctx == nil {
+		return t.next.RoundTrip(r)
+	}
+	op := consulOperation(r)
+	_, sp := t.tracer.start(t.ctx, "consul "+op, spanKindClient, "", "")
+	sp.SetAttr("consul.operation", op)
+	sp.SetAttr("http.method", r.Method)
+	sp.SetAttr("http.url", r.URL.Path)
+	sp.SetAttr("net.peer.name", r.URL.Host)
+
+	// the request of a RoundTripper must not be modified
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = make(http.Header, len(r.Header)+1)
+	for k, v := range r.Header {
+		r2.Header[k] = v
+	}
+	r2.Header.Set(traceparentHeader, sp.Traceparent())
+	if sp.TraceState != "" {
+		r2.Header.Set(tracestateHeader, sp.TraceState)
+	}
+
+	resp, err := t.next.RoundTrip(r2)
+	switch {
+	case err != nil:
+		sp.SetError(err.Error())
+	case resp.StatusCode >= 400 && resp.StatusCode != http.StatusNotFound:
+		sp.SetAttr("http.status_code", resp.StatusCode)
+		sp.SetError(resp.Status)
+	default:
+		sp.SetAttr("http.status_code", resp.StatusCode)
+	}
+	t.tracer.finish(sp)
+	return resp, err
+}
+
+// newConsulClient returns a consul client of opts which sends its requests
+// with transport.
+func newConsulClient(opts opts.Options, transport http.RoundTripper) (*api.Client, error) {
+	return api.NewClient(&api.Config{
+		Address:    opts.Consul,
+		Token:      opts.ConsulToken,
+		HttpClient: &http.Client{Transport: transport},
+	})
+}
+
+// tracedConsulClient returns a consul client whose requests are child spans
+// of the span of ctx, or client when the request is not traced. The consul
+// client has no context for its writes, so a traced request is given a
+// client of its own. The calls a client makes in the background, such as
+// the renewal of a session, may outlive the request: they are still children
+// of its span and never of the span of another request.
+func (t *tracer) tracedConsulClient(ctx context.Context, opts opts.Options, client *api.Client, transport http.RoundTripper) *api.Client {
+	if sp := spanOf(ctx); t == nil || sp == nil || !sp.Sampled {
+		return client
+	}
+	traced, err := newConsulClient(opts, &traceTransport{ctx: ctx, tracer: t, next: transport})
+	if err != nil {
+		return client
+	}
+	return traced
+}
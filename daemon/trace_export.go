@@ -0,0 +1,207 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	traceServiceName    = "zlb-api"
+	defaultOtlpEndpoint = "http://localhost:4318"
+	otlpTracesPath      = "/v1/traces"
+)
+
+// spanExporter sends finished spans to a tracing backend.
+type spanExporter interface {
+	Export(spans []*span) error
+}
+
+// the OTLP/HTTP JSON encoding of an ExportTraceServiceRequest, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	TraceState        string     `json:"traceState,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpValue is an AnyValue, 64 bits integers are strings in the JSON encoding.
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    string   `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func newOtlpAttr(k string, v interface{}) otlpAttr {
+	a := otlpAttr{Key: k}
+	switch v := v.(type) {
+	case bool:
+		a.Value.BoolValue = &v
+	case int:
+		a.Value.IntValue = strconv.Itoa(v)
+	case int64:
+		a.Value.IntValue = strconv.FormatInt(v, 10)
+	case uint64:
+		a.Value.IntValue = strconv.FormatUint(v, 10)
+	case float64:
+		a.Value.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		a.Value.StringValue = &s
+	}
+	return a
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func encodeSpans(spans []*span) ([]byte, error) {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, sp := range spans {
+		sp.mu.Lock()
+		keys := make([]string, 0, len(sp.attrs))
+		for k := range sp.attrs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		attrs := make([]otlpAttr, 0, len(keys))
+		for _, k := range keys {
+			attrs = append(attrs, newOtlpAttr(k, sp.attrs[k]))
+		}
+		status := otlpStatus{Code: sp.Status, Message: sp.Message}
+		sp.mu.Unlock()
+
+		out = append(out, otlpSpan{
+			TraceID:           sp.TraceID,
+			SpanID:            sp.SpanID,
+			ParentSpanID:      sp.ParentID,
+			TraceState:        sp.TraceState,
+			Name:              sp.Name,
+			Kind:              sp.Kind,
+			StartTimeUnixNano: unixNano(sp.Start),
+			EndTimeUnixNano:   unixNano(sp.End),
+			Attributes:        attrs,
+			Status:            status,
+		})
+	}
+	return json.Marshal(&otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttr{newOtlpAttr("service.name", traceServiceName)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "github.com/zanecloud/zlb/api"}, Spans: out}},
+	}}})
+}
+
+// otlpExporter posts the spans to an OTLP/HTTP collector in the JSON
+// encoding.
+type otlpExporter struct {
+	url  string
+	http *http.Client
+}
+
+// newOtlpExporter returns an exporter to the collector at endpoint, the base
+// url of the collector or the url of its traces.
+func newOtlpExporter(endpoint string) *otlpExporter {
+	if endpoint == "" {
+		endpoint = defaultOtlpEndpoint
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(endpoint, otlpTracesPath) {
+		endpoint += otlpTracesPath
+	}
+	return &otlpExporter{url: endpoint, http: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (e *otlpExporter) Export(spans []*span) error {
+	body, err := encodeSpans(spans)
+	if err != nil {
+		return err
+	}
+	resp, err := e.http.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// fileExporter appends each batch of spans to a file as a line of OTLP JSON,
+// the format of the file exporter of the OpenTelemetry collector.
+type fileExporter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func newFileExporter(path string) (*fileExporter, error) {
+	if path == "" {
+		return nil, errors.New("the file exporter needs a trace-endpoint")
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileExporter{file: f}, nil
+}
+
+func (e *fileExporter) Export(spans []*span) error {
+	line, err := encodeSpans(spans)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.file.Write(append(line, '\n'))
+	return err
+}
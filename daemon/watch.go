@@ -0,0 +1,204 @@
+package daemon
+
+import (
+	"context"
+	"encoding/base64"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+	"github.com/zanecloud/zlb/api/types"
+)
+
+const zlbPrefix = "zlb/"
+
+func decodePath(s string) string {
+	if strings.HasPrefix(s, "path_") {
+		udec, _ := base64.URLEncoding.DecodeString(s[5:])
+		return string(udec)
+	}
+	return s
+}
+
+// newChangeEvent classifies a zlb/ key, it returns nil for keys which are
+// neither a cfg, a server nor a cookie filter.
+func newChangeEvent(key, action, old, new string) *types.ChangeEvent {
+	parts := strings.Split(strings.TrimPrefix(key, zlbPrefix), "/")
+	if len(parts) < 3 {
+		return nil
+	}
+	e := &types.ChangeEvent{
+		Type:   parts[1],
+		Action: action,
+		Domain: parts[0],
+		Key:    key,
+		Old:    old,
+		New:    new,
+		Time:   time.Now().Unix(),
+	}
+	switch {
+	case e.Type == "cfg" && len(parts) == 3:
+		e.Path = decodePath(parts[2])
+	case e.Type == "server" && len(parts) == 4:
+		e.Path = decodePath(parts[2])
+		e.Server = parts[3]
+	case e.Type == "ckfilter" && len(parts) == 4:
+		e.Name = parts[2]
+		e.Value = parts[3]
+	default:
+		return nil
+	}
+	e.ID = newID()
+	return e
+}
+
+// treeWatcher follows the zlb/ prefix with consul blocking queries, keeps
+// the latest snapshot of it and notifies its listeners about every key that
+// changed.
+type treeWatcher struct {
+	client *api.Client
+
+	mu        sync.RWMutex
+	index     uint64
+	pairs     map[string]*api.KVPair
+	listeners []func([]*types.ChangeEvent)
+}
+
+func newTreeWatcher(client *api.Client) *treeWatcher {
+	return &treeWatcher{client: client}
+}
+
+func (w *treeWatcher) OnChange(fn func([]*types.ChangeEvent)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.listeners = append(w.listeners, fn)
+}
+
+func (w *treeWatcher) Run(ctx context.Context) {
+	backoff := time.Second
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		w.mu.RLock()
+		index := w.index
+		w.mu.RUnlock()
+
+		pairs, meta, err := w.client.KV().List(zlbPrefix, &api.QueryOptions{
+			WaitIndex: index,
+			WaitTime:  5 * time.Minute,
+			Context:   ctx,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logrus.Warnf("watch %s fail :%s", zlbPrefix, err.Error())
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+
+		// consul may reset its index, e.g. after a snapshot restore
+		if meta.LastIndex < index {
+			meta.LastIndex = 0
+		}
+		if meta.LastIndex == index && index != 0 {
+			continue
+		}
+		w.update(pairs, meta.LastIndex)
+	}
+}
+
+func (w *treeWatcher) update(pairs api.KVPairs, index uint64) {
+	values := make(map[string]*api.KVPair, len(pairs))
+	for _, pair := range pairs {
+		values[pair.Key] = pair
+	}
+
+	w.mu.Lock()
+	old := w.pairs
+	w.pairs = values
+	w.index = index
+	listeners := w.listeners
+	w.mu.Unlock()
+
+	// the first snapshot is the baseline, not a change
+	if old == nil {
+		return
+	}
+
+	var events []*types.ChangeEvent
+	for k, v := range values {
+		ov, ok := old[k]
+		var e *types.ChangeEvent
+		switch {
+		case !ok:
+			e = newChangeEvent(k, "create", "", string(v.Value))
+		case string(ov.Value) != string(v.Value):
+			e = newChangeEvent(k, "update", string(ov.Value), string(v.Value))
+		}
+		if e != nil {
+			events = append(events, e)
+		}
+	}
+	for k, ov := range old {
+		if _, ok := values[k]; !ok {
+			if e := newChangeEvent(k, "delete", string(ov.Value), ""); e != nil {
+				events = append(events, e)
+			}
+		}
+	}
+	if len(events) == 0 {
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{"index": index, "events": len(events)}).Debug("zlb tree changed")
+	for _, fn := range listeners {
+		fn(events)
+	}
+}
+
+// Snapshot returns the cached pairs under prefix sorted by key and the consul
+// index they were read at, ok is false until the first query has returned.
+func (w *treeWatcher) Snapshot(prefix string) (pairs api.KVPairs, index uint64, ok bool) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.pairs == nil {
+		return nil, 0, false
+	}
+	for k, pair := range w.pairs {
+		if strings.HasPrefix(k, prefix) {
+			pairs = append(pairs, pair)
+		}
+	}
+	sort.Sort(pairsByKey(pairs))
+	return pairs, w.index, true
+}
+
+// Index returns the consul index of the snapshot, ok is false until the
+// first query has returned.
+func (w *treeWatcher) Index() (index uint64, ok bool) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.index, w.pairs != nil
+}
+
+type pairsByKey api.KVPairs
+
+func (p pairsByKey) Len() int           { return len(p) }
+func (p pairsByKey) Less(i, j int) bool { return p[i].Key < p[j].Key }
+func (p pairsByKey) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
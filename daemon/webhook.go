@@ -0,0 +1,415 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/consul/api"
+	"github.com/zanecloud/zlb/api/types"
+)
+
+const (
+	webhookPrefix    = "zlb-api/webhooks/"
+	deadLetterPrefix = "zlb-api/deadletters/"
+
+	webhookMaxAttempts = 6
+	webhookBaseDelay   = time.Second
+	webhookMaxDelay    = 2 * time.Minute
+	webhookQueueSize   = 1024
+
+	// held by the instance which dispatches the events
+	webhookLockKey = "zlb-api/locks/webhooks"
+)
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookDispatcher posts change events to the subscribed webhooks, retrying
+// with exponential backoff and recording undeliverable events as dead letters.
+// Each webhook has a worker and a bounded queue of its own, so that its
+// events are delivered in order and a slow webhook only delays itself. Events
+// are only dispatched by the instance which holds the webhooks lock, every
+// instance of a cluster sees the same changes. The events which do not fit in
+// a queue, or are pending when its context is cancelled, are recorded as dead
+// letters too, so that a shutdown does not lose events.
+type webhookDispatcher struct {
+	client *api.Client
+	leader *leader
+	http   *http.Client
+	ctx    context.Context
+	delay  time.Duration // the delay of the first retry
+
+	mu     sync.Mutex
+	queues map[string]chan *webhookDelivery
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type webhookDelivery struct {
+	hook  *types.Webhook
+	event *types.ChangeEvent
+}
+
+var errWebhookQueueFull = errors.New("the queue of the webhook is full")
+
+func newWebhookDispatcher(ctx context.Context, client *api.Client, leader *leader) *webhookDispatcher {
+	return &webhookDispatcher{
+		client: client,
+		leader: leader,
+		http:   &http.Client{Timeout: 10 * time.Second},
+		ctx:    ctx,
+		delay:  webhookBaseDelay,
+		queues: map[string]chan *webhookDelivery{},
+	}
+}
+
+func (d *webhookDispatcher) Dispatch(events []*types.ChangeEvent) {
+	if !d.leader.IsLeader() {
+		return
+	}
+	hooks, err := listWebhooks(d.client)
+	if err != nil {
+		logrus.Errorf("list webhooks fail :%s", err.Error())
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	ids := map[string]bool{}
+	for _, hook := range hooks {
+		ids[hook.ID] = true
+		for _, e := range events {
+			if !hook.Wants(e) {
+				continue
+			}
+			queue, ok := d.queues[hook.ID]
+			if !ok {
+				queue = make(chan *webhookDelivery, webhookQueueSize)
+				d.queues[hook.ID] = queue
+				d.wg.Add(1)
+				go d.work(queue)
+			}
+			select {
+			case queue <- &webhookDelivery{hook: hook, event: e}:
+			default:
+				logrus.WithFields(logrus.Fields{"webhook": hook.ID, "event": e.ID}).Warnf("deliver webhook fail :%s", errWebhookQueueFull.Error())
+				d.deadLetter(hook, e, 0, errWebhookQueueFull)
+			}
+		}
+	}
+	// the workers of the removed webhooks stop once their queue is done
+	for id, queue := range d.queues {
+		if !ids[id] {
+			close(queue)
+			delete(d.queues, id)
+		}
+	}
+}
+
+// Wait stops the workers, it returns once the events of their queues are
+// delivered or recorded as dead letters.
+func (d *webhookDispatcher) Wait() {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		for id, queue := range d.queues {
+			close(queue)
+			delete(d.queues, id)
+		}
+	}
+	d.mu.Unlock()
+	d.wg.Wait()
+}
+
+func (d *webhookDispatcher) work(queue <-chan *webhookDelivery) {
+	defer d.wg.Done()
+	for delivery := range queue {
+		if err := d.ctx.Err(); err != nil {
+			d.deadLetter(delivery.hook, delivery.event, 0, err)
+			continue
+		}
+		d.deliver(delivery.hook, delivery.event)
+	}
+}
+
+func (d *webhookDispatcher) deliver(hook *types.Webhook, e *types.ChangeEvent) {
+	body, _ := json.Marshal(e)
+	delay := d.delay
+	var lastErr error
+	attempt := 1
+	for ; ; attempt++ {
+		if lastErr = d.post(hook, e, body); lastErr == nil {
+			return
+		}
+		logrus.WithFields(logrus.Fields{"webhook": hook.ID, "event": e.ID, "attempt": attempt}).Warnf("deliver webhook fail :%s", lastErr.Error())
+		if attempt == webhookMaxAttempts || d.ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-d.ctx.Done():
+		case <-time.After(delay):
+		}
+		if d.ctx.Err() != nil {
+			lastErr = d.ctx.Err()
+			break
+		}
+		if delay *= 2; delay > webhookMaxDelay {
+			delay = webhookMaxDelay
+		}
+	}
+	d.deadLetter(hook, e, attempt, lastErr)
+}
+
+func (d *webhookDispatcher) deadLetter(hook *types.Webhook, e *types.ChangeEvent, attempts int, lastErr error) {
+	dl, _ := json.Marshal(&types.DeadLetter{
+		Webhook:   hook.ID,
+		URL:       hook.URL,
+		Event:     e,
+		Attempts:  attempts,
+		LastError: lastErr.Error(),
+		Time:      time.Now().Unix(),
+	})
+	consulkey := deadLetterPrefix + hook.ID + "/" + e.ID
+	if _, err := d.client.KV().Put(&api.KVPair{Key: consulkey, Value: dl}, nil); err != nil {
+		logrus.WithFields(logrus.Fields{"consulkey": consulkey}).Errorf("put consule fail :%s", err.Error())
+	}
+}
+
+func (d *webhookDispatcher) post(hook *types.Webhook, e *types.ChangeEvent, body []byte) error {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Zlb-Event", e.Type)
+	req.Header.Set("X-Zlb-Delivery", e.ID)
+	if hook.Secret != "" {
+		req.Header.Set("X-Zlb-Signature", sign(hook.Secret, body))
+	}
+	resp, err := d.http.Do(req.WithContext(d.ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func listWebhooks(client *api.Client) ([]*types.Webhook, error) {
+	pairs, _, err := client.KV().List(webhookPrefix, nil)
+	if err != nil {
+		return nil, err
+	}
+	hooks := make([]*types.Webhook, 0, len(pairs))
+	for _, pair := range pairs {
+		hook := &types.Webhook{}
+		if err := json.Unmarshal(pair.Value, hook); err != nil {
+			logrus.WithFields(logrus.Fields{"consulkey": pair.Key}).Warnf("invalid webhook :%s", err.Error())
+			continue
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+func getWebhook(client *api.Client, id string) (*types.Webhook, error) {
+	pair, _, err := client.KV().Get(webhookPrefix+id, nil)
+	if err != nil || pair == nil {
+		return nil, err
+	}
+	hook := &types.Webhook{}
+	if err := json.Unmarshal(pair.Value, hook); err != nil {
+		return nil, err
+	}
+	return hook, nil
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	jsonstr, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonstr)
+}
+
+func getWebhookList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	client, _ := ctx.Value(KEY_CONSUL_CLIENT).(*api.Client)
+	hooks, err := listWebhooks(client)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, hook := range hooks {
+		hook.Secret = ""
+	}
+	writeJson(w, hooks)
+}
+
+func getWebhookJson(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	client, _ := ctx.Value(KEY_CONSUL_CLIENT).(*api.Client)
+	hook, err := getWebhook(client, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if hook == nil {
+		http.Error(w, "No such webhook", http.StatusNotFound)
+		return
+	}
+	hook.Secret = ""
+	writeJson(w, hook)
+}
+
+func saveWebhook(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	client, _ := ctx.Value(KEY_CONSUL_CLIENT).(*api.Client)
+	id := mux.Vars(r)["id"]
+
+	req := &types.Webhook{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if id == "" {
+		req.ID = newID()
+		req.Created = time.Now().Unix()
+	} else {
+		old, err := getWebhook(client, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if old == nil {
+			http.Error(w, "No such webhook", http.StatusNotFound)
+			return
+		}
+		req.ID = old.ID
+		req.Created = old.Created
+		if req.Secret == "" {
+			req.Secret = old.Secret
+		}
+	}
+
+	jsonstr, _ := json.Marshal(req)
+	consulkey := webhookPrefix + req.ID
+	if isDryRun(r) {
+		writeWebhookDryRun(w, client, map[string]string{consulkey: string(jsonstr)}, nil)
+		return
+	}
+	if _, err := client.KV().Put(&api.KVPair{Key: consulkey, Value: jsonstr}, nil); err != nil {
+		logger(ctx).WithFields(logrus.Fields{"consulkey": consulkey}).Infof("put consule fail :%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.Secret = ""
+	writeJson(w, req)
+}
+
+func removeWebhook(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	client, _ := ctx.Value(KEY_CONSUL_CLIENT).(*api.Client)
+	id := mux.Vars(r)["id"]
+
+	consulkey := webhookPrefix + id
+	if isDryRun(r) {
+		writeWebhookDryRun(w, client, nil, []string{consulkey, deadLetterPrefix + id + "/"})
+		return
+	}
+	if _, err := client.KV().Delete(consulkey, nil); err != nil {
+		logger(ctx).WithFields(logrus.Fields{"consulkey": consulkey}).Infof("delete consule fail :%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	consulkey = deadLetterPrefix + id + "/"
+	if _, err := client.KV().DeleteTree(consulkey, nil); err != nil {
+		logger(ctx).WithFields(logrus.Fields{"consulkey": consulkey}).Infof("delete consule fail :%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// writeWebhookDryRun is writeDryRun without the secrets of the webhooks.
+func writeWebhookDryRun(w http.ResponseWriter, client *api.Client, set map[string]string, del []string) {
+	changes, err := planRequest(client, set, del)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, c := range changes {
+		if strings.HasPrefix(c.Key, webhookPrefix) {
+			c.Old = redactSecret(c.Old)
+			c.New = redactSecret(c.New)
+		}
+	}
+	writeJson(w, &types.ApplyReport{Changes: changes, DryRun: true})
+}
+
+func redactSecret(value string) string {
+	hook := &types.Webhook{}
+	if value == "" || json.Unmarshal([]byte(value), hook) != nil {
+		return value
+	}
+	hook.Secret = ""
+	jsonstr, _ := json.Marshal(hook)
+	return string(jsonstr)
+}
+
+func getDeadLetterList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	client, _ := ctx.Value(KEY_CONSUL_CLIENT).(*api.Client)
+	id := mux.Vars(r)["id"]
+
+	pairs, _, err := client.KV().List(deadLetterPrefix+id+"/", nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	letters := make([]*types.DeadLetter, 0, len(pairs))
+	for _, pair := range pairs {
+		dl := &types.DeadLetter{}
+		if err := json.Unmarshal(pair.Value, dl); err != nil {
+			continue
+		}
+		letters = append(letters, dl)
+	}
+	writeJson(w, letters)
+}
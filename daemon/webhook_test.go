@@ -0,0 +1,213 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/zanecloud/zlb/api/types"
+)
+
+// fakeKV serves the kv endpoints of consul the dispatcher uses from a map.
+type fakeKV struct {
+	mu    sync.Mutex
+	pairs map[string][]byte
+}
+
+func (kv *fakeKV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	switch r.Method {
+	case "PUT":
+		value, _ := ioutil.ReadAll(r.Body)
+		kv.pairs[key] = value
+		w.Write([]byte("true"))
+	case "GET":
+		var pairs api.KVPairs
+		for k, v := range kv.pairs {
+			if k == key || r.URL.Query()["recurse"] != nil && strings.HasPrefix(k, key) {
+				pairs = append(pairs, &api.KVPair{Key: k, Value: v})
+			}
+		}
+		if len(pairs) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		sort.Sort(pairsByKey(pairs))
+		w.Header().Set("X-Consul-Index", "1")
+		json.NewEncoder(w).Encode(pairs)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (kv *fakeKV) get(key string) []byte {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.pairs[key]
+}
+
+// newTestDispatcher returns a dispatcher, which holds the webhooks lock, over
+// a fake consul with hook registered.
+func newTestDispatcher(t *testing.T, ctx context.Context, hook *types.Webhook) (*webhookDispatcher, *fakeKV, func()) {
+	value, _ := json.Marshal(hook)
+	kv := &fakeKV{pairs: map[string][]byte{webhookPrefix + hook.ID: value}}
+	srv := httptest.NewServer(kv)
+	client, err := api.NewClient(&api.Config{Address: strings.TrimPrefix(srv.URL, "http://")})
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	l := newLeader(client, webhookLockKey)
+	l.setHeld(true)
+	d := newWebhookDispatcher(ctx, client, l)
+	d.delay = time.Millisecond
+	return d, kv, srv.Close
+}
+
+func testEvents(n int) []*types.ChangeEvent {
+	events := make([]*types.ChangeEvent, n)
+	for i := range events {
+		events[i] = newChangeEvent(zlbPrefix+"a.com/cfg/"+encodePath("/"), "update", "", string(rune('a'+i)))
+		events[i].ID = newID()
+	}
+	return events
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	var mu sync.Mutex
+	var got []*types.ChangeEvent
+	received := make(chan struct{}, 16)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if sig := r.Header.Get("X-Zlb-Signature"); sig != sign("s3cret", body) {
+			t.Errorf("X-Zlb-Signature = %q, want %q", sig, sign("s3cret", body))
+		}
+		if typ := r.Header.Get("X-Zlb-Event"); typ != "cfg" {
+			t.Errorf("X-Zlb-Event = %q, want cfg", typ)
+		}
+		e := &types.ChangeEvent{}
+		if err := json.Unmarshal(body, e); err != nil {
+			t.Errorf("invalid event %q: %s", body, err)
+		}
+		if id := r.Header.Get("X-Zlb-Delivery"); id != e.ID {
+			t.Errorf("X-Zlb-Delivery = %q, want %q", id, e.ID)
+		}
+		mu.Lock()
+		got = append(got, e)
+		mu.Unlock()
+		received <- struct{}{}
+	}))
+	defer receiver.Close()
+
+	hook := &types.Webhook{ID: "h1", URL: receiver.URL, Secret: "s3cret"}
+	d, _, stop := newTestDispatcher(t, context.Background(), hook)
+	defer stop()
+
+	events := testEvents(6)
+	d.Dispatch(events[:3])
+	d.Dispatch(events[3:])
+	for range events {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the deliveries")
+		}
+	}
+	d.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != len(events) {
+		t.Fatalf("got %d deliveries, want %d", len(got), len(events))
+	}
+	for i, e := range got {
+		if e.ID != events[i].ID {
+			t.Errorf("delivery %d is event %s, want %s", i, e.ID, events[i].ID)
+		}
+	}
+}
+
+func TestWebhookNotLeader(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected delivery")
+	}))
+	defer receiver.Close()
+
+	d, _, stop := newTestDispatcher(t, context.Background(), &types.Webhook{ID: "h1", URL: receiver.URL})
+	defer stop()
+	d.leader.setHeld(false)
+	d.Dispatch(testEvents(1))
+	d.Wait()
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		mu.Unlock()
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	hook := &types.Webhook{ID: "h1", URL: receiver.URL}
+	d, kv, stop := newTestDispatcher(t, context.Background(), hook)
+	defer stop()
+
+	events := testEvents(1)
+	d.Dispatch(events)
+	d.Wait()
+
+	if attempts != webhookMaxAttempts {
+		t.Errorf("got %d attempts, want %d", attempts, webhookMaxAttempts)
+	}
+	value := kv.get(deadLetterPrefix + hook.ID + "/" + events[0].ID)
+	if value == nil {
+		t.Fatal("no dead letter recorded")
+	}
+	dl := &types.DeadLetter{}
+	if err := json.Unmarshal(value, dl); err != nil {
+		t.Fatal(err)
+	}
+	if dl.Webhook != hook.ID || dl.URL != hook.URL || dl.Attempts != webhookMaxAttempts || dl.Event == nil || dl.Event.ID != events[0].ID {
+		t.Errorf("unexpected dead letter %s", value)
+	}
+	if !strings.Contains(dl.LastError, "503") {
+		t.Errorf("LastError = %q, want the status of the last attempt", dl.LastError)
+	}
+}
+
+func TestWebhookShutdown(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	hook := &types.Webhook{ID: "h1", URL: receiver.URL}
+	d, kv, stop := newTestDispatcher(t, ctx, hook)
+	defer stop()
+	d.delay = time.Hour
+
+	events := testEvents(3)
+	d.Dispatch(events)
+	cancel()
+	d.Wait()
+
+	for _, e := range events {
+		if kv.get(deadLetterPrefix+hook.ID+"/"+e.ID) == nil {
+			t.Errorf("no dead letter recorded for the pending event %s", e.ID)
+		}
+	}
+}
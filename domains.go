@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/codegangsta/cli"
+	"github.com/zanecloud/zlb/api/client"
+	"github.com/zanecloud/zlb/api/types"
+)
+
+var dryRunFlag = cli.BoolFlag{
+	Name:  "dry-run",
+	Usage: "only print the keys which would be written or deleted",
+}
+
+var pathFlag = cli.StringFlag{
+	Name:  "path, p",
+	Value: "/",
+	Usage: "path of the domain",
+}
+
+var domainCfgFlags = []cli.Flag{
+	pathFlag,
+	dryRunFlag,
+	cli.StringFlag{Name: "file, f", Usage: "read the whole cfg from a json file instead of the flags below, the Service and DNS sources are only set this way"},
+	cli.StringFlag{Name: "type", Value: "http", Usage: "health check type (options: http, https, tcp, grpc, redis, mysql, exec, or empty for none)"},
+	cli.StringFlag{Name: "uri", Usage: "health check uri, http and https"},
+	cli.StringFlag{Name: "valid-statuses", Usage: "health check valid statuses, comma separated, http and https"},
+	cli.IntFlag{Name: "interval", Usage: "health check interval in milliseconds"},
+	cli.IntFlag{Name: "timeout", Usage: "health check timeout in milliseconds"},
+	cli.IntFlag{Name: "fall", Usage: "failed checks before a server is down"},
+	cli.IntFlag{Name: "rise", Usage: "successful checks before a server is up"},
+	cli.IntFlag{Name: "concurrency", Usage: "health check concurrency"},
+	cli.StringFlag{Name: "sni", Usage: "health check tls server name, https and grpc over tls (default: the domain)"},
+	cli.BoolFlag{Name: "skip-verify", Usage: "do not verify the certificates of the servers, https and grpc over tls"},
+	cli.BoolFlag{Name: "tls", Usage: "check over tls, grpc"},
+	cli.StringFlag{Name: "grpc-service", Usage: "service of the grpc health check (default: the whole server)"},
+	cli.StringFlag{Name: "mysql-user", Usage: "user the mysql check logs in as, without password"},
+	cli.StringFlag{Name: "command", Usage: "absolute path of the command of the exec check"},
+	cli.IntFlag{Name: "keepalive", Usage: "keepalive connections to the servers"},
+	cli.BoolFlag{Name: "sticky", Usage: "enable session stickiness"},
+	cli.StringFlag{Name: "balancer", Usage: "balancing algorithm (options: round_robin, weighted_round_robin, least_conn, hash, random_two)"},
+	cli.StringSliceFlag{Name: "weight", Usage: "HOST:PORT=WEIGHT of weighted_round_robin, repeated for each server"},
+	cli.StringFlag{Name: "hash-on", Usage: "what hash hashes on (options: header, cookie, uri)"},
+	cli.StringFlag{Name: "hash-key", Usage: "name of the header or the cookie hash hashes on"},
+	cli.IntFlag{Name: "consecutive-5xx", Usage: "5xx answers in a row which eject a server, enables the passive check"},
+	cli.IntFlag{Name: "consecutive-errors", Usage: "connection errors in a row which eject a server, enables the passive check"},
+	cli.IntFlag{Name: "ejection-time", Usage: "time an ejected server gets no request, in milliseconds"},
+	cli.IntFlag{Name: "max-ejection-percent", Usage: "percent of the servers which can be ejected at once"},
+}
+
+// balancerFlags returns the balancer of the flags, nil when --balancer is
+// not set.
+func balancerFlags(c *cli.Context) (*types.BalancerCfg, error) {
+	if c.String("balancer") == "" {
+		return nil, nil
+	}
+	b := &types.BalancerCfg{Algorithm: c.String("balancer"), Hash_on: c.String("hash-on"), Hash_key: c.String("hash-key")}
+	for _, w := range c.StringSlice("weight") {
+		i := strings.LastIndex(w, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid --weight %q, expecting HOST:PORT=WEIGHT", w)
+		}
+		weight, err := strconv.Atoi(w[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid --weight %q, expecting HOST:PORT=WEIGHT", w)
+		}
+		if b.Weights == nil {
+			b.Weights = map[string]int{}
+		}
+		b.Weights[w[:i]] = weight
+	}
+	return b, nil
+}
+
+// passiveFlags returns the passive check of the flags, nil when neither of
+// the thresholds is set.
+func passiveFlags(c *cli.Context) *types.PassiveCheckCfg {
+	if c.Int("consecutive-5xx") == 0 && c.Int("consecutive-errors") == 0 {
+		return nil
+	}
+	return &types.PassiveCheckCfg{
+		Consecutive_5xx:      c.Int("consecutive-5xx"),
+		Consecutive_errors:   c.Int("consecutive-errors"),
+		Ejection_time:        c.Int("ejection-time"),
+		Max_ejection_percent: c.Int("max-ejection-percent"),
+	}
+}
+
+var domainsCommand = cli.Command{
+	Name:  "domains",
+	Usage: "manage the domains of a running zlb api",
+	Subcommands: []cli.Command{
+		{
+			Name:   "list",
+			Usage:  "list domains",
+			Flags:  withClientFlags(),
+			Action: listDomainsCommand,
+		},
+		{
+			Name:      "inspect",
+			Usage:     "show the cfg, servers and cookie filters of a domain",
+			ArgsUsage: "DOMAIN",
+			Flags:     withClientFlags(),
+			Action:    inspectDomainCommand,
+		},
+		{
+			Name:      "create",
+			Usage:     "create the cfg of a domain path",
+			ArgsUsage: "DOMAIN",
+			Flags:     withClientFlags(domainCfgFlags...),
+			Action:    saveDomainCommand("create"),
+		},
+		{
+			Name:      "update",
+			Usage:     "update the cfg of a domain path",
+			ArgsUsage: "DOMAIN",
+			Flags:     withClientFlags(domainCfgFlags...),
+			Action:    saveDomainCommand("update"),
+		},
+		{
+			Name:      "remove",
+			Usage:     "remove a domain with all its paths, servers and cookie filters",
+			ArgsUsage: "DOMAIN",
+			Flags:     withClientFlags(dryRunFlag),
+			Action:    removeDomainCommand,
+		},
+	},
+}
+
+var serversCommand = cli.Command{
+	Name:  "servers",
+	Usage: "manage the backend servers of a domain path",
+	Subcommands: []cli.Command{
+		{
+			Name:      "add",
+			Usage:     "add servers to a domain path",
+			ArgsUsage: "DOMAIN HOST:PORT...",
+			Flags:     withClientFlags(pathFlag, dryRunFlag),
+			Action:    serversCommandAction("add"),
+		},
+		{
+			Name:      "remove",
+			Usage:     "remove servers from a domain path",
+			ArgsUsage: "DOMAIN HOST:PORT...",
+			Flags:     withClientFlags(pathFlag, dryRunFlag),
+			Action:    serversCommandAction("remove"),
+		},
+	},
+}
+
+var filtersCommand = cli.Command{
+	Name:  "filters",
+	Usage: "manage the cookie filters of a domain",
+	Subcommands: []cli.Command{
+		{
+			Name:      "set",
+			Usage:     "set the filter on a cookie value",
+			ArgsUsage: "DOMAIN",
+			Flags: withClientFlags(dryRunFlag,
+				cli.StringFlag{Name: "name", Usage: "cookie name"},
+				cli.StringFlag{Name: "value", Usage: "cookie value"},
+				cli.Int64Flag{Name: "lifecycle", Usage: "0 to let the cookie through, greater than 0 to filter it"},
+			),
+			Action: setFilterCommand,
+		},
+		{
+			Name:      "list",
+			Usage:     "list the cookie filters of a domain",
+			ArgsUsage: "DOMAIN",
+			Flags:     withClientFlags(),
+			Action:    listFiltersCommand,
+		},
+		{
+			Name:      "delete",
+			Usage:     "delete the filter on a cookie value, or on all values of a cookie",
+			ArgsUsage: "DOMAIN",
+			Flags: withClientFlags(dryRunFlag,
+				cli.StringFlag{Name: "name", Usage: "cookie name"},
+				cli.StringFlag{Name: "value", Usage: "cookie value, all values when empty"},
+			),
+			Action: deleteFilterCommand,
+		},
+	},
+}
+
+func domainArg(c *cli.Context) (string, error) {
+	name := c.Args().First()
+	if name == "" {
+		return "", cli.NewExitError("Please set DOMAIN", exitUsage)
+	}
+	return name, nil
+}
+
+func writeOptions(c *cli.Context) *client.WriteOptions {
+	return &client.WriteOptions{DryRun: c.Bool("dry-run")}
+}
+
+// printWrite prints "ok" or, on a dry run, the plan of a mutating request.
+func printWrite(c *cli.Context, report *types.ApplyReport, err error) error {
+	if err != nil {
+		return exitCode(err)
+	}
+	if report == nil {
+		fmt.Println("ok")
+		return nil
+	}
+	if c.String("output") == "json" {
+		return printJson(report)
+	}
+	printChanges(os.Stdout, report.Changes)
+	return nil
+}
+
+func listDomainsCommand(c *cli.Context) error {
+	names, _, err := newClient(c).ListDomains(context.Background(), nil)
+	if err != nil {
+		return exitCode(err)
+	}
+	if c.String("output") == "json" {
+		return printJson(names)
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+	return nil
+}
+
+func inspectDomainCommand(c *cli.Context) error {
+	name, err := domainArg(c)
+	if err != nil {
+		return err
+	}
+	tree, _, err := newClient(c).InspectDomain(context.Background(), name, nil)
+	if err != nil {
+		return exitCode(err)
+	}
+	d := subtree(subtree(tree, "zlb"), name)
+	if d == nil {
+		return cli.NewExitError("No such domain "+name, exitNotFound)
+	}
+	if c.String("output") == "json" {
+		return printJson(tree)
+	}
+
+	var paths []string
+	seen := map[string]bool{}
+	for _, kind := range []string{"cfg", "server"} {
+		for path := range subtree(d, kind) {
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	sort.Strings(paths)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATH\tTYPE\tURI\tVALID STATUSES\tKEEPALIVE\tSTICKY\tSERVERS")
+	for _, path := range paths {
+		cfg := &types.DomainCfg{}
+		if s, ok := subtree(d, "cfg")[path].(string); ok {
+			json.Unmarshal([]byte(s), cfg)
+		}
+		var servers []string
+		for s := range subtree(subtree(d, "server"), path) {
+			servers = append(servers, s)
+		}
+		sort.Strings(servers)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%t\t%s\n", path, cfg.Healthcheck.Type, cfg.Healthcheck.Uri,
+			cfg.Healthcheck.Valid_statuses, cfg.KeepAlive, cfg.Sticky, strings.Join(servers, ","))
+	}
+	tw.Flush()
+
+	if ckfilter := subtree(d, "ckfilter"); len(ckfilter) > 0 {
+		fmt.Println()
+		printFilters(filtersOf(ckfilter))
+	}
+	return nil
+}
+
+// subtree returns the child object of an inspect answer, nil if it is not one.
+func subtree(tree map[string]interface{}, key string) map[string]interface{} {
+	m, _ := tree[key].(map[string]interface{})
+	return m
+}
+
+func filtersOf(ckfilter map[string]interface{}) []*types.CookieFilter {
+	var filters []*types.CookieFilter
+	for name := range ckfilter {
+		for value, lifecycle := range subtree(ckfilter, name) {
+			f := &types.CookieFilter{Name: name, Value: value}
+			fmt.Sscanf(fmt.Sprint(lifecycle), "%d", &f.Lifecycle)
+			filters = append(filters, f)
+		}
+	}
+	sort.Slice(filters, func(i, j int) bool {
+		return filters[i].Name+"/"+filters[i].Value < filters[j].Name+"/"+filters[j].Value
+	})
+	return filters
+}
+
+func printFilters(filters []*types.CookieFilter) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "COOKIE\tVALUE\tLIFECYCLE")
+	for _, f := range filters {
+		fmt.Fprintf(tw, "%s\t%s\t%d\n", f.Name, f.Value, f.Lifecycle)
+	}
+	tw.Flush()
+}
+
+func saveDomainCommand(action string) func(*cli.Context) error {
+	return func(c *cli.Context) error {
+		name, err := domainArg(c)
+		if err != nil {
+			return err
+		}
+		cfg := &types.DomainCfg{
+			Healthcheck: types.HealthCheckCfg{
+				Type:           c.String("type"),
+				Uri:            c.String("uri"),
+				Valid_statuses: c.String("valid-statuses"),
+				Interval:       c.Int("interval"),
+				Timeout:        c.Int("timeout"),
+				Fall:           c.Int("fall"),
+				Rise:           c.Int("rise"),
+				Concurrency:    c.Int("concurrency"),
+				Sni:            c.String("sni"),
+				Skip_verify:    c.Bool("skip-verify"),
+				Tls:            c.Bool("tls"),
+				Grpc_service:   c.String("grpc-service"),
+				Mysql_user:     c.String("mysql-user"),
+				Command:        c.String("command"),
+			},
+			Passive:   passiveFlags(c),
+			Sticky:    c.Bool("sticky"),
+			KeepAlive: c.Int("keepalive"),
+			Path:      c.String("path"),
+		}
+		if cfg.Balancer, err = balancerFlags(c); err != nil {
+			return cli.NewExitError(err.Error(), exitUsage)
+		}
+		if file := c.String("file"); file != "" {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return cli.NewExitError(err.Error(), exitUsage)
+			}
+			cfg = &types.DomainCfg{}
+			if err := json.Unmarshal(data, cfg); err != nil {
+				return cli.NewExitError(file+": "+err.Error(), exitUsage)
+			}
+		}
+		cl := newClient(c)
+		save := cl.CreateDomain
+		if action == "update" {
+			save = cl.UpdateDomain
+		}
+		report, err := save(context.Background(), name, cfg, writeOptions(c))
+		return printWrite(c, report, err)
+	}
+}
+
+func removeDomainCommand(c *cli.Context) error {
+	name, err := domainArg(c)
+	if err != nil {
+		return err
+	}
+	report, err := newClient(c).RemoveDomain(context.Background(), name, writeOptions(c))
+	return printWrite(c, report, err)
+}
+
+func serversCommandAction(action string) func(*cli.Context) error {
+	return func(c *cli.Context) error {
+		name, err := domainArg(c)
+		if err != nil {
+			return err
+		}
+		servers := c.Args().Tail()
+		if len(servers) == 0 {
+			return cli.NewExitError("Please set HOST:PORT", exitUsage)
+		}
+		cl := newClient(c)
+		do := cl.AddServers
+		if action == "remove" {
+			do = cl.RemoveServers
+		}
+		report, err := do(context.Background(), name, &types.ServerList{Path: c.String("path"), Servers: servers}, writeOptions(c))
+		return printWrite(c, report, err)
+	}
+}
+
+func setFilterCommand(c *cli.Context) error {
+	name, err := domainArg(c)
+	if err != nil {
+		return err
+	}
+	if c.String("name") == "" || c.String("value") == "" {
+		return cli.NewExitError("Please set --name and --value", exitUsage)
+	}
+	f := &types.CookieFilter{Name: c.String("name"), Value: c.String("value"), Lifecycle: c.Int64("lifecycle")}
+	report, err := newClient(c).SetCookieFilter(context.Background(), name, f, writeOptions(c))
+	return printWrite(c, report, err)
+}
+
+func listFiltersCommand(c *cli.Context) error {
+	name, err := domainArg(c)
+	if err != nil {
+		return err
+	}
+	filters, _, err := newClient(c).ListCookieFilters(context.Background(), name, nil)
+	if err != nil {
+		return exitCode(err)
+	}
+	if c.String("output") == "json" {
+		return printJson(filters)
+	}
+	printFilters(filters)
+	return nil
+}
+
+func deleteFilterCommand(c *cli.Context) error {
+	name, err := domainArg(c)
+	if err != nil {
+		return err
+	}
+	if c.String("name") == "" {
+		return cli.NewExitError("Please set --name", exitUsage)
+	}
+	f := &types.CookieFilter{Name: c.String("name"), Value: c.String("value")}
+	report, err := newClient(c).DeleteCookieFilter(context.Background(), name, f, writeOptions(c))
+	return printWrite(c, report, err)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/codegangsta/cli"
+	"github.com/hashicorp/consul/api"
+	"github.com/zanecloud/zlb/api/daemon"
+)
+
+var importCommand = cli.Command{
+	Name:  "import",
+	Usage: "import domains into consul from another load balancer configuration",
+	Subcommands: []cli.Command{
+		{
+			Name:  "nginx",
+			Usage: "import the server, location and upstream blocks of an nginx configuration",
+			Flags: []cli.Flag{
+				consulAddrFlag,
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "nginx configuration file",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only report what would be written",
+				},
+			},
+			Action: importNginxCommand,
+		},
+	},
+}
+
+func importNginxCommand(c *cli.Context) error {
+	if c.String("file") == "" {
+		return cli.NewExitError("Please set --file", 2)
+	}
+	conf, err := ioutil.ReadFile(c.String("file"))
+	if err != nil {
+		return err
+	}
+	domains, warnings, err := daemon.ImportNginx(conf)
+	if err != nil {
+		return err
+	}
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+	}
+
+	client, err := api.NewClient(&api.Config{Address: c.String("consul-addr")})
+	if err != nil {
+		return err
+	}
+	changes, err := daemon.ImportDomains(context.Background(), client, domains, c.Bool("dry-run"))
+	printChanges(os.Stdout, changes)
+	if err != nil {
+		return err
+	}
+	if c.Bool("dry-run") {
+		fmt.Printf("dry run, %d changes not applied\n", len(changes))
+	} else {
+		fmt.Printf("%d changes applied\n", len(changes))
+	}
+	return nil
+}
@@ -6,8 +6,6 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
-	"github.com/zanecloud/zlb/api/daemon"
-	"github.com/zanecloud/zlb/api/opts"
 )
 
 var (
@@ -16,6 +14,13 @@ var (
 	BuildTime string
 )
 
+var consulAddrFlag = cli.StringFlag{
+	Name:   "consul-addr",
+	Value:  "localhost:8500",
+	EnvVar: "CONSUL_ADDR",
+	Usage:  "consul addr",
+}
+
 func main() {
 
 	app := cli.NewApp()
@@ -38,7 +43,7 @@ func main() {
 		logrus.SetOutput(os.Stderr)
 		level, err := logrus.ParseLevel(c.String("log-level"))
 		if err != nil {
-			logrus.Fatalf(err.Error())
+			logrus.Fatal(err)
 		}
 		logrus.SetLevel(level)
 		return nil
@@ -46,38 +51,23 @@ func main() {
 
 	app.Commands = []cli.Command{
 		{
-			Name:  "start",
-			Usage: "start a zlb api ",
-			Flags: []cli.Flag{
-
-				cli.StringFlag{
-					Name:   "consul-addr",
-					Value:  "localhost:8500",
-					EnvVar: "CONSUL_ADDR",
-					Usage:  "consul addr",
-				},
-				cli.StringFlag{
-					Name:   "addr",
-					EnvVar: "ZLB_ADDR",
-					Value:  "localhost:6300",
-					Usage:  "zlb addr",
-				},
-			},
+			Name:   "start",
+			Usage:  "start a zlb api ",
+			Flags:  startFlags,
 			Action: startCommand,
 		},
+		renderCommand,
+		importCommand,
+		applyCommand,
+		exportCommand,
+		restoreCommand,
+		domainsCommand,
+		serversCommand,
+		filtersCommand,
+		configCommand,
 	}
 
 	if err := app.Run(os.Args); err != nil {
 		logrus.Fatal(err)
 	}
 }
-
-func startCommand(cli *cli.Context) {
-
-	opts := opts.Options{}
-	opts.Consul = cli.String("consul-addr")
-	opts.Address = cli.String("addr")
-
-	daemon.Run(opts)
-
-}
@@ -0,0 +1,68 @@
+package opts
+
+import (
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const redacted = "<redacted>"
+
+// File is the content of the config file given with --config, its keys are
+// the names of the flags of the start command.
+type File struct {
+	LogLevel        string        `yaml:"log-level"`
+	Addr            string        `yaml:"addr"`
+	ConsulAddr      string        `yaml:"consul-addr"`
+	ConsulToken     string        `yaml:"consul-token"`
+	TLSCert         string        `yaml:"tls-cert"`
+	TLSKey          string        `yaml:"tls-key"`
+	AuthToken       string        `yaml:"auth-token"`
+	ReadTimeout     time.Duration `yaml:"read-timeout"`
+	WriteTimeout    time.Duration `yaml:"write-timeout"`
+	IdleTimeout     time.Duration `yaml:"idle-timeout"`
+	ShutdownTimeout time.Duration `yaml:"shutdown-timeout"`
+	TraceExporter   string        `yaml:"trace-exporter"`
+	TraceEndpoint   string        `yaml:"trace-endpoint"`
+	DNSResolver     string        `yaml:"dns-resolver"`
+}
+
+func ReadFile(path string) (*File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{}
+	if err := yaml.UnmarshalStrict(data, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// FileOf returns the config file content of o, with its secrets redacted.
+func FileOf(o Options) *File {
+	f := &File{
+		LogLevel:        o.Loglevel,
+		Addr:            o.Address,
+		ConsulAddr:      o.Consul,
+		ConsulToken:     o.ConsulToken,
+		TLSCert:         o.TLSCert,
+		TLSKey:          o.TLSKey,
+		AuthToken:       o.AuthToken,
+		ReadTimeout:     o.ReadTimeout,
+		WriteTimeout:    o.WriteTimeout,
+		IdleTimeout:     o.IdleTimeout,
+		ShutdownTimeout: o.ShutdownTimeout,
+		TraceExporter:   o.TraceExporter,
+		TraceEndpoint:   o.TraceEndpoint,
+		DNSResolver:     o.DNSResolver,
+	}
+	if f.ConsulToken != "" {
+		f.ConsulToken = redacted
+	}
+	if f.AuthToken != "" {
+		f.AuthToken = redacted
+	}
+	return f
+}
@@ -1,8 +1,95 @@
 package opts
 
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
 type Options struct {
-	Version  bool
-	Loglevel string
-	Address  string
-	Consul   string
+	Version         bool
+	Loglevel        string
+	Address         string
+	Consul          string
+	ConsulToken     string
+	TLSCert         string // the server listens with TLS when set, along with TLSKey
+	TLSKey          string
+	AuthToken       string // bearer token required on the zlb routes when set
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+	TraceExporter   string // none, otlp or file
+	TraceEndpoint   string // the url of the OTLP collector, or the file the spans are written to
+	DNSResolver     string // host:port of the nameserver of the dns sources, the first of resolv.conf when empty
+	BuildVersion    string
+	GitCommit       string
+	BuildTime       string
+
+	// Reload is called on SIGHUP, it returns the options read again from the
+	// config file. Only the log level is applied to a running server.
+	Reload func() (Options, error)
+}
+
+// Validate checks the options before the server starts.
+func (o *Options) Validate() error {
+	if _, err := logrus.ParseLevel(o.Loglevel); err != nil {
+		return fmt.Errorf("log-level: %s", err.Error())
+	}
+	if _, _, err := net.SplitHostPort(o.Address); err != nil {
+		return fmt.Errorf("addr: %s", err.Error())
+	}
+	if o.Consul == "" {
+		return errors.New("consul-addr: must not be empty")
+	}
+	if (o.TLSCert == "") != (o.TLSKey == "") {
+		return errors.New("tls-cert and tls-key must be set together")
+	}
+	if o.TLSCert != "" {
+		if _, err := tls.LoadX509KeyPair(o.TLSCert, o.TLSKey); err != nil {
+			return fmt.Errorf("tls-cert: %s", err.Error())
+		}
+	}
+	for name, d := range map[string]time.Duration{
+		"read-timeout":  o.ReadTimeout,
+		"write-timeout": o.WriteTimeout,
+		"idle-timeout":  o.IdleTimeout,
+	} {
+		if d < 0 {
+			return fmt.Errorf("%s: must not be negative", name)
+		}
+	}
+	if o.ShutdownTimeout <= 0 {
+		return errors.New("shutdown-timeout: must be positive")
+	}
+	if o.DNSResolver != "" {
+		if _, _, err := net.SplitHostPort(o.DNSResolver); err != nil {
+			return fmt.Errorf("dns-resolver: %s", err.Error())
+		}
+	}
+	switch o.TraceExporter {
+	case "", "none":
+	case "otlp":
+		if o.TraceEndpoint != "" {
+			u, err := url.Parse(o.TraceEndpoint)
+			if err != nil {
+				return fmt.Errorf("trace-endpoint: %s", err.Error())
+			}
+			if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+				return errors.New("trace-endpoint: must be an http or https url with the otlp exporter")
+			}
+		}
+	case "file":
+		if o.TraceEndpoint == "" {
+			return errors.New("trace-endpoint: must be the path of a file with the file exporter")
+		}
+	default:
+		return fmt.Errorf("trace-exporter: unknown exporter %q, must be none, otlp or file", o.TraceExporter)
+	}
+	return nil
 }
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/zanecloud/zlb/api/types"
+)
+
+// printChanges writes a plan in a diff like format, one line per key.
+func printChanges(w io.Writer, changes []*types.KVChange) {
+	for _, c := range changes {
+		switch {
+		case c.Op == "delete":
+			fmt.Fprintf(w, "- %s = %q\n", c.Key, c.Old)
+		case c.Index == 0 && c.Old == "":
+			fmt.Fprintf(w, "+ %s = %q\n", c.Key, c.New)
+		default:
+			fmt.Fprintf(w, "~ %s = %q -> %q\n", c.Key, c.Old, c.New)
+		}
+	}
+	if len(changes) == 0 {
+		fmt.Fprintf(w, "no changes\n")
+	}
+}
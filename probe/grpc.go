@@ -0,0 +1,271 @@
+package probe
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// the ServingStatus of a grpc.health.v1.HealthCheckResponse
+var servingStatus = []string{"UNKNOWN", "SERVING", "NOT_SERVING", "SERVICE_UNKNOWN"}
+
+var errNoMessage = errors.New("grpc: no HealthCheckResponse")
+
+const (
+	http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+	http2FrameData         = 0
+	http2FrameHeaders      = 1
+	http2FrameRSTStream    = 3
+	http2FrameSettings     = 4
+	http2FramePing         = 6
+	http2FrameGoAway       = 7
+	http2FlagEndStream     = 0x1
+	http2FlagAck           = 0x1
+	http2FlagEndHeaders    = 0x4
+	http2FlagPadded        = 0x8
+	http2MaxFrameSize      = 1 << 14
+	grpcHealthCheckPath    = "/grpc.health.v1.Health/Check"
+	grpcMaxResponseMessage = 4096
+)
+
+// hpackInt appends n with the prefix of the first byte, of prefix bits, and
+// the bits of flags above it.
+func hpackInt(b []byte, flags byte, prefix uint, n int) []byte {
+	max := 1<<prefix - 1
+	if n < max {
+		return append(b, flags|byte(n))
+	}
+	b = append(b, flags|byte(max))
+	for n -= max; n >= 128; n >>= 7 {
+		b = append(b, byte(n&0x7f|0x80))
+	}
+	return append(b, byte(n))
+}
+
+// hpackString appends a string literal without huffman coding.
+func hpackString(b []byte, s string) []byte {
+	return append(hpackInt(b, 0, 7, len(s)), s...)
+}
+
+// grpcRequestHeaders returns the header block of the health check call. The
+// fields are literals without indexing so that the encoder has no dynamic
+// table to keep.
+func grpcRequestHeaders(secure bool, authority string) []byte {
+	b := []byte{0x83} // :method POST, static index 3
+	if secure {
+		b = append(b, 0x87) // :scheme https
+	} else {
+		b = append(b, 0x86) // :scheme http
+	}
+	for _, f := range []struct {
+		index int
+		value string
+	}{
+		{4, grpcHealthCheckPath}, // :path
+		{1, authority},           // :authority
+		{31, "application/grpc"}, // content-type
+		{58, userAgent},          // user-agent
+	} {
+		b = hpackString(hpackInt(b, 0, 4, f.index), f.value)
+	}
+	b = hpackString(append(b, 0), "te")
+	return hpackString(b, "trailers")
+}
+
+func writeHTTP2Frame(w io.Writer, typ, flags byte, stream uint32, payload []byte) error {
+	frame := make([]byte, 9, 9+len(payload))
+	n := len(payload)
+	frame[0], frame[1], frame[2] = byte(n>>16), byte(n>>8), byte(n)
+	frame[3], frame[4] = typ, flags
+	binary.BigEndian.PutUint32(frame[5:], stream&0x7fffffff)
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
+
+// grpc calls grpc.health.v1.Health/Check over http/2, in clear text unless the
+// check is over tls. The server is up when it answers SERVING.
+//
+// The standard library of the toolchain zlb-api is built with has no http/2
+// client for clear text, nor for a custom tls config, so the call is made on
+// a connection of its own with the few frames it needs. The response headers
+// are not decoded, the answer is the message of the DATA frames.
+func (c *Check) grpc(ctx context.Context, server string) error {
+	// a HealthCheckRequest whose field 1 is the service, in a grpc frame
+	var msg []byte
+	if c.GrpcService != "" {
+		var size [binary.MaxVarintLen64]byte
+		msg = append([]byte{0x0a}, size[:binary.PutUvarint(size[:], uint64(len(c.GrpcService)))]...)
+		msg = append(msg, c.GrpcService...)
+	}
+	call := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(call[1:], uint32(len(msg)))
+	call = append(call, msg...)
+	if len(call) > http2MaxFrameSize {
+		return fmt.Errorf("grpc: service name too long")
+	}
+
+	conn, err := dial(ctx, server)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if c.Tls {
+		config := c.tlsConfig()
+		config.NextProtos = []string{"h2"}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		if proto := tlsConn.ConnectionState().NegotiatedProtocol; proto != "h2" {
+			return fmt.Errorf("grpc: the server does not speak http/2 over tls")
+		}
+		conn = tlsConn
+	}
+
+	authority := c.Host
+	if authority == "" {
+		authority = server
+	}
+	w := bufio.NewWriter(conn)
+	w.WriteString(http2Preface)
+	writeHTTP2Frame(w, http2FrameSettings, 0, 0, nil)
+	writeHTTP2Frame(w, http2FrameHeaders, http2FlagEndHeaders, 1, grpcRequestHeaders(c.Tls, authority))
+	writeHTTP2Frame(w, http2FrameData, http2FlagEndStream, 1, call)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	body, err := readGrpcResponse(conn)
+	if err != nil {
+		return err
+	}
+	serving, err := parseHealthResponse(body)
+	if err != nil {
+		return err
+	}
+	if serving != 1 {
+		if serving < uint64(len(servingStatus)) {
+			return fmt.Errorf("grpc: %s", servingStatus[serving])
+		}
+		return fmt.Errorf("grpc: serving status %d", serving)
+	}
+	return nil
+}
+
+// readGrpcResponse reads the frames of the connection until the message of
+// stream 1 is complete, or the stream ends without one.
+func readGrpcResponse(conn net.Conn) ([]byte, error) {
+	r := bufio.NewReader(conn)
+	var body []byte
+	var header [9]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, err
+		}
+		n := int(header[0])<<16 | int(header[1])<<8 | int(header[2])
+		typ, flags := header[3], header[4]
+		stream := binary.BigEndian.Uint32(header[5:]) & 0x7fffffff
+		if n > http2MaxFrameSize {
+			return nil, errors.New("grpc: frame too large")
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, err
+		}
+
+		switch {
+		case typ == http2FrameSettings && flags&http2FlagAck == 0:
+			if err := writeHTTP2Frame(conn, http2FrameSettings, http2FlagAck, 0, nil); err != nil {
+				return nil, err
+			}
+		case typ == http2FramePing && flags&http2FlagAck == 0:
+			if err := writeHTTP2Frame(conn, http2FramePing, http2FlagAck, 0, payload); err != nil {
+				return nil, err
+			}
+		case typ == http2FrameGoAway:
+			return nil, errors.New("grpc: the server closed the connection")
+		case stream != 1:
+		case typ == http2FrameRSTStream && len(payload) == 4:
+			return nil, fmt.Errorf("grpc: stream reset with error code %d", binary.BigEndian.Uint32(payload))
+		case typ == http2FrameData:
+			if flags&http2FlagPadded != 0 {
+				if len(payload) == 0 || int(payload[0]) >= len(payload) {
+					return nil, errors.New("grpc: malformed DATA frame")
+				}
+				payload = payload[1 : len(payload)-int(payload[0])]
+			}
+			if body = append(body, payload...); len(body) > grpcMaxResponseMessage {
+				return nil, errors.New("grpc: HealthCheckResponse too large")
+			}
+			if len(body) >= 5 && len(body) >= 5+int(binary.BigEndian.Uint32(body[1:])) {
+				return body, nil
+			}
+			if flags&http2FlagEndStream != 0 {
+				return nil, errNoMessage
+			}
+		case typ == http2FrameHeaders && flags&http2FlagEndStream != 0:
+			// the trailers, or the headers of a failed call without message
+			return nil, errNoMessage
+		}
+	}
+}
+
+// parseHealthResponse returns the status, field 1, of the HealthCheckResponse
+// in the grpc frame of body.
+func parseHealthResponse(body []byte) (uint64, error) {
+	if len(body) < 5 {
+		return 0, errNoMessage
+	}
+	if body[0] != 0 {
+		return 0, errors.New("grpc: compressed HealthCheckResponse")
+	}
+	n := binary.BigEndian.Uint32(body[1:])
+	if uint32(len(body)-5) < n {
+		return 0, errNoMessage
+	}
+	msg := body[5 : 5+n]
+
+	var status uint64
+	for len(msg) > 0 {
+		key, k := binary.Uvarint(msg)
+		if k <= 0 {
+			return 0, errNoMessage
+		}
+		msg = msg[k:]
+		switch key & 7 {
+		case 0:
+			v, k := binary.Uvarint(msg)
+			if k <= 0 {
+				return 0, errNoMessage
+			}
+			if key>>3 == 1 {
+				status = v
+			}
+			msg = msg[k:]
+		case 1, 5:
+			size := 8
+			if key&7 == 5 {
+				size = 4
+			}
+			if len(msg) < size {
+				return 0, errNoMessage
+			}
+			msg = msg[size:]
+		case 2:
+			l, k := binary.Uvarint(msg)
+			if k <= 0 || uint64(len(msg)-k) < l {
+				return 0, errNoMessage
+			}
+			msg = msg[k+int(l):]
+		default:
+			return 0, errNoMessage
+		}
+	}
+	return status, nil
+}
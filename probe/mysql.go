@@ -0,0 +1,103 @@
+package probe
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	mysqlClientLongPassword     = 0x00000001
+	mysqlClientProtocol41       = 0x00000200
+	mysqlClientSecureConnection = 0x00008000
+)
+
+var errMysqlPacket = errors.New("mysql: malformed packet")
+
+func readMysqlPacket(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	n := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	if n == 0 {
+		return nil, errMysqlPacket
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func writeMysqlPacket(w io.Writer, seq byte, payload []byte) error {
+	n := len(payload)
+	_, err := w.Write(append([]byte{byte(n), byte(n >> 8), byte(n >> 16), seq}, payload...))
+	return err
+}
+
+// mysqlError returns the error of an ERR packet.
+func mysqlError(p []byte) error {
+	if len(p) < 3 {
+		return errMysqlPacket
+	}
+	code := binary.LittleEndian.Uint16(p[1:])
+	msg := p[3:]
+	if len(msg) >= 6 && msg[0] == '#' {
+		msg = msg[6:]
+	}
+	return fmt.Errorf("mysql: error %d: %s", code, msg)
+}
+
+// mysql reads the handshake of the server, and logs in as the user without
+// password when there is one, as the mysql-check of haproxy does with
+// post-41. The server is up when it accepts the connection, and the login.
+func (c *Check) mysql(ctx context.Context, server string) error {
+	conn, err := dial(ctx, server)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	p, err := readMysqlPacket(r)
+	if err != nil {
+		return err
+	}
+	switch p[0] {
+	case 0xff:
+		return mysqlError(p)
+	case 10:
+	default:
+		return fmt.Errorf("mysql: unsupported protocol version %d", p[0])
+	}
+	if c.MysqlUser == "" {
+		return nil
+	}
+
+	login := make([]byte, 32, 32+len(c.MysqlUser)+2)
+	binary.LittleEndian.PutUint32(login, mysqlClientLongPassword|mysqlClientProtocol41|mysqlClientSecureConnection)
+	binary.LittleEndian.PutUint32(login[4:], 1<<24)
+	login[8] = 0x21 // utf8_general_ci
+	login = append(login, c.MysqlUser...)
+	login = append(login, 0, 0) // the end of the user, an empty auth response
+	if err := writeMysqlPacket(conn, 1, login); err != nil {
+		return err
+	}
+	if p, err = readMysqlPacket(r); err != nil {
+		return err
+	}
+	switch p[0] {
+	case 0x00:
+		writeMysqlPacket(conn, 0, []byte{0x01}) // COM_QUIT
+		return nil
+	case 0xff:
+		return mysqlError(p)
+	case 0xfe:
+		return fmt.Errorf("mysql: %s needs an authentication plugin, the check user must use mysql_native_password", c.MysqlUser)
+	}
+	return fmt.Errorf("mysql: unexpected reply 0x%02x to the login", p[0])
+}
@@ -0,0 +1,166 @@
+// Package probe runs the health checks of the domain paths on demand, the
+// way the LB nodes run them, so that a cfg can be validated before the data
+// plane picks it up.
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zanecloud/zlb/api/types"
+)
+
+// Check is a health check with the defaults of the data plane applied. The
+// exec checks are not run, they would run commands on the api host.
+type Check struct {
+	Type          string        // http, https, tcp, grpc, redis or mysql
+	Host          string        // the Host header of the http checks, the domain
+	Uri           string        // the uri of the http checks
+	ValidStatuses []string      // the valid status codes of the http checks, 2xx and 3xx when empty
+	Timeout       time.Duration // of each check
+	Sni           string        // the server name of the tls checks, Host when empty
+	SkipVerify    bool          // do not verify the certificate of the tls checks
+	Tls           bool          // the grpc check is over tls
+	GrpcService   string        // the service of the grpc check, the whole server when empty
+	MysqlUser     string        // the mysql check logs in as this user, without password
+}
+
+// Run runs the check against the servers, at most concurrency at a time. The
+// results are in the order of servers.
+func Run(ctx context.Context, c *Check, servers []string, concurrency int) []*types.ProbeResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([]*types.ProbeResult, len(servers))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, server string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = c.Run(ctx, server)
+		}(i, s)
+	}
+	wg.Wait()
+	return results
+}
+
+// Run checks one server.
+func (c *Check) Run(ctx context.Context, server string) *types.ProbeResult {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	result := &types.ProbeResult{Server: server}
+	start := time.Now()
+	var err error
+	switch c.Type {
+	case "tcp":
+		err = c.tcp(ctx, server)
+	case "http", "https":
+		result.StatusCode, err = c.http(ctx, server)
+	case "grpc":
+		err = c.grpc(ctx, server)
+	case "redis":
+		err = c.redis(ctx, server)
+	case "mysql":
+		err = c.mysql(ctx, server)
+	default:
+		err = fmt.Errorf("unsupported check type %q", c.Type)
+	}
+	result.LatencyMs = float64(time.Since(start).Nanoseconds()) / 1e6
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Up = true
+	}
+	return result
+}
+
+// dial connects to the server, the connection times out with ctx.
+func dial(ctx context.Context, server string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
+
+func (c *Check) tcp(ctx context.Context, server string) error {
+	conn, err := dial(ctx, server)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (c *Check) tlsConfig() *tls.Config {
+	sni := c.Sni
+	if sni == "" {
+		sni = c.Host
+	}
+	return &tls.Config{ServerName: sni, InsecureSkipVerify: c.SkipVerify}
+}
+
+const userAgent = "zlb-api-probe"
+
+// a check is one request on a connection of its own, redirects are answers
+var checkClient = &http.Client{
+	Transport: &http.Transport{DisableKeepAlives: true},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func (c *Check) http(ctx context.Context, server string) (int, error) {
+	uri := c.Uri
+	if uri == "" {
+		uri = "/"
+	}
+	client, scheme := checkClient, "http"
+	if c.Type == "https" {
+		client = &http.Client{
+			Transport:     &http.Transport{DisableKeepAlives: true, TLSClientConfig: c.tlsConfig()},
+			CheckRedirect: checkClient.CheckRedirect,
+		}
+		scheme = "https"
+	}
+	req, err := http.NewRequest("GET", scheme+"://"+server+uri, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Host = c.Host
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if !c.validStatus(resp.StatusCode) {
+		return resp.StatusCode, fmt.Errorf("invalid status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func (c *Check) validStatus(code int) bool {
+	if len(c.ValidStatuses) == 0 {
+		return code >= 200 && code < 400
+	}
+	for _, s := range c.ValidStatuses {
+		if s == strconv.Itoa(code) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,32 @@
+package probe
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+)
+
+// redis sends a PING without authenticating, as the redis-check of haproxy
+// does, the server is up when it answers PONG.
+func (c *Check) redis(ctx context.Context, server string) error {
+	conn, err := dial(ctx, server)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("*1\r\n$4\r\nPING\r\n")); err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	switch line = strings.TrimSpace(line); {
+	case line == "+PONG":
+		return nil
+	case strings.HasPrefix(line, "-"):
+		return fmt.Errorf("redis: %s", line[1:])
+	}
+	return fmt.Errorf("redis: unexpected reply %q", line)
+}
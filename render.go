@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/codegangsta/cli"
+	"github.com/hashicorp/consul/api"
+	"github.com/zanecloud/zlb/api/daemon"
+	"github.com/zanecloud/zlb/api/types"
+)
+
+var renderCommand = cli.Command{
+	Name:  "render",
+	Usage: "render the data plane configuration of domains from consul",
+	Subcommands: []cli.Command{
+		{
+			Name:   "nginx",
+			Usage:  "render nginx/openresty upstream and server blocks",
+			Flags:  renderFlags,
+			Action: renderAction(daemon.RenderNginx),
+		},
+		{
+			Name:   "haproxy",
+			Usage:  "render haproxy frontend and backend blocks",
+			Flags:  renderFlags,
+			Action: renderAction(daemon.RenderHaproxy),
+		},
+	},
+}
+
+var renderFlags = []cli.Flag{
+	consulAddrFlag,
+	cli.StringFlag{
+		Name:  "domain, d",
+		Usage: "render only this domain",
+	},
+}
+
+func renderAction(render func(io.Writer, []*types.Domain) error) func(*cli.Context) error {
+	return func(c *cli.Context) error {
+		client, err := api.NewClient(&api.Config{Address: c.String("consul-addr")})
+		if err != nil {
+			return err
+		}
+		domains, err := daemon.LoadDomains(client, c.String("domain"))
+		if err != nil {
+			return err
+		}
+		if c.String("domain") != "" && len(domains) == 0 {
+			return cli.NewExitError("No such domain "+c.String("domain"), 1)
+		}
+		return render(os.Stdout, domains)
+	}
+}
@@ -1,4 +1,9 @@
 #!/usr/bin/env bash
 
+ZLB_ADDR=${ZLB_ADDR:-localhost:6300}
+AUTH=()
+if [ -n "$ZLB_AUTH_TOKEN" ]; then
+	AUTH=(-H "Authorization: Bearer $ZLB_AUTH_TOKEN")
+fi
 
-curl -X POST -d @scripts/tunneld-service.json "http://localhost:6400/services/create"
\ No newline at end of file
+curl -sf -X POST "${AUTH[@]}" -d @scripts/tunneld-service.json "http://$ZLB_ADDR/zlb/services/create"
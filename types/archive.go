@@ -0,0 +1,21 @@
+package types
+
+import "encoding/json"
+
+const ArchiveVersion = 1
+
+// Archive is a portable copy of the zlb/ tree. Paths are decoded and cfg
+// values are kept as json documents, keys which do not belong to a domain
+// cfg, server or cookie filter are kept verbatim in Other.
+type Archive struct {
+	Version int                       `json:"Version"`
+	Time    int64                     `json:"Time"`
+	Domains map[string]*ArchiveDomain `json:"Domains"`
+	Other   map[string]string         `json:"Other,omitempty"`
+}
+
+type ArchiveDomain struct {
+	Cfg      map[string]json.RawMessage   `json:"Cfg,omitempty"`      // path -> cfg
+	Server   map[string]map[string]string `json:"Server,omitempty"`   // path -> server -> value
+	Ckfilter map[string]map[string]string `json:"Ckfilter,omitempty"` // name -> value -> lifecycle
+}
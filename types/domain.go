@@ -0,0 +1,410 @@
+// Package types holds the request and response shapes of the zlb api which
+// are shared by the daemon, the client package and the command line.
+package types
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// HealthCheckCfg is the active health check of the servers of a domain path,
+// there is none when Type is empty. The fields after Concurrency only apply
+// to some types.
+type HealthCheckCfg struct {
+	Type           string `json:"Type" yaml:"type"` // http, https, tcp, grpc, redis, mysql or exec
+	Uri            string `json:"Uri,omitempty" yaml:"uri,omitempty"`
+	Valid_statuses string `json:"Valid_statuses,omitempty" yaml:"valid_statuses,omitempty"`
+	Interval       int    `json:"Interval,omitempty" yaml:"interval,omitempty"`
+	Timeout        int    `json:"Timeout,omitempty" yaml:"timeout,omitempty"`
+	Fall           int    `json:"Fall,omitempty" yaml:"fall,omitempty"`
+	Rise           int    `json:"Rise,omitempty" yaml:"rise,omitempty"`
+	Concurrency    int    `json:"Concurrency,omitempty" yaml:"concurrency,omitempty"`
+	Sni            string `json:"Sni,omitempty" yaml:"sni,omitempty"`                   // https and grpc over tls, the domain when empty
+	Skip_verify    bool   `json:"Skip_verify,omitempty" yaml:"skip_verify,omitempty"`   // https and grpc over tls
+	Tls            bool   `json:"Tls,omitempty" yaml:"tls,omitempty"`                   // grpc, in clear text otherwise
+	Grpc_service   string `json:"Grpc_service,omitempty" yaml:"grpc_service,omitempty"` // grpc, the whole server when empty
+	Mysql_user     string `json:"Mysql_user,omitempty" yaml:"mysql_user,omitempty"`     // mysql, logs in without password when set
+	Command        string `json:"Command,omitempty" yaml:"command,omitempty"`           // exec, the absolute path of the command
+}
+
+// PassiveCheckCfg ejects the servers of a domain path which fail the live
+// requests in a row, a server is sent requests again after Ejection_time.
+// Zero fields get the defaults of the data plane.
+type PassiveCheckCfg struct {
+	Consecutive_5xx      int `json:"Consecutive_5xx,omitempty" yaml:"consecutive_5xx,omitempty"`           // 5xx answers which eject a server, 0 to not count them
+	Consecutive_errors   int `json:"Consecutive_errors,omitempty" yaml:"consecutive_errors,omitempty"`     // connection errors and timeouts which eject a server, 0 to not count them
+	Ejection_time        int `json:"Ejection_time,omitempty" yaml:"ejection_time,omitempty"`               // in ms
+	Max_ejection_percent int `json:"Max_ejection_percent,omitempty" yaml:"max_ejection_percent,omitempty"` // of the servers which can be ejected at once
+}
+
+// BalancerCfg chooses how the requests of a domain path are spread over its
+// servers. The fields after Algorithm only apply to some algorithms.
+type BalancerCfg struct {
+	Algorithm string         `json:"Algorithm" yaml:"algorithm"`                   // round_robin, weighted_round_robin, least_conn, hash or random_two
+	Weights   map[string]int `json:"Weights,omitempty" yaml:"weights,omitempty"`   // weighted_round_robin, by host:port, 1 for the servers without
+	Hash_on   string         `json:"Hash_on,omitempty" yaml:"hash_on,omitempty"`   // hash, the header, the cookie or the uri
+	Hash_key  string         `json:"Hash_key,omitempty" yaml:"hash_key,omitempty"` // hash, the name of the header or of the cookie
+}
+
+type DomainCfg struct {
+	Healthcheck HealthCheckCfg   `json:"Healthcheck" yaml:"healthcheck"`
+	Passive     *PassiveCheckCfg `json:"Passive,omitempty" yaml:"passive,omitempty"`   // no passive check when nil
+	Balancer    *BalancerCfg     `json:"Balancer,omitempty" yaml:"balancer,omitempty"` // round robin when nil
+	Sticky      bool             `json:"Sticky,omitempty" yaml:"sticky,omitempty"`
+	KeepAlive   int              `json:"KeepAlive,omitempty" yaml:"keepalive,omitempty"`
+	Path        string           `json:"Path,omitempty" yaml:"path,omitempty"`
+	Service     *ServiceSource   `json:"Service,omitempty" yaml:"service,omitempty"` // the servers are synced from consul when set
+	DNS         *DNSSource       `json:"DNS,omitempty" yaml:"dns,omitempty"`         // the servers are synced from dns when set
+}
+
+// ServiceSource makes the servers of a domain path the passing instances of
+// a consul service which have all the tags. The servers are kept when no
+// instance passes, unless AllowEmpty.
+type ServiceSource struct {
+	Name       string   `json:"Name" yaml:"name"`
+	Tags       []string `json:"Tags,omitempty" yaml:"tags,omitempty"`
+	Datacenter string   `json:"Datacenter,omitempty" yaml:"datacenter,omitempty"`
+	AllowEmpty bool     `json:"AllowEmpty,omitempty" yaml:"allowempty,omitempty"` // remove all the servers when no instance passes
+}
+
+// DNSSource makes the servers of a domain path the addresses a dns name
+// resolves to. The name is resolved again when its records expire, the
+// servers are kept when it cannot be resolved.
+type DNSSource struct {
+	Name string `json:"Name" yaml:"name"`
+	Type string `json:"Type,omitempty" yaml:"type,omitempty"` // A, for the A and AAAA records, or SRV
+	Port int    `json:"Port,omitempty" yaml:"port,omitempty"` // the port of the servers of A records
+}
+
+// the names consul can resolve with its DNS interface
+var validServiceName = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9_.-]*[a-zA-Z0-9])?$`)
+
+func validateTags(tags []string) error {
+	for _, tag := range tags {
+		if tag == "" || strings.ContainsAny(tag, " \t\n/") {
+			return fmt.Errorf("invalid tag %q", tag)
+		}
+	}
+	return nil
+}
+
+var (
+	healthCheckTypes = []string{"http", "https", "tcp", "grpc", "redis", "mysql", "exec"}
+	validStatusCode  = regexp.MustCompile(`^[1-5][0-9][0-9]$`)
+)
+
+// Validate checks the type of the check and its fields. Uri and
+// Valid_statuses are ignored by the checks which are not http or https, as
+// they always were, the other fields of a type are refused on the others.
+func (h *HealthCheckCfg) Validate() error {
+	if h.Type != "" && !contains(healthCheckTypes, h.Type) {
+		return fmt.Errorf("invalid Type %q, expecting one of %s", h.Type, strings.Join(healthCheckTypes, ", "))
+	}
+	names := []string{"Interval", "Timeout", "Fall", "Rise", "Concurrency"}
+	for i, v := range []int{h.Interval, h.Timeout, h.Fall, h.Rise, h.Concurrency} {
+		if v < 0 {
+			return fmt.Errorf("%s must not be negative", names[i])
+		}
+	}
+
+	tls := h.Type == "https" || h.Type == "grpc" && h.Tls
+	only := []struct {
+		field string
+		set   bool
+		ok    bool
+		types string
+	}{
+		{"Sni", h.Sni != "", tls, "https and grpc over tls"},
+		{"Skip_verify", h.Skip_verify, tls, "https and grpc over tls"},
+		{"Tls", h.Tls, h.Type == "grpc", "grpc"},
+		{"Grpc_service", h.Grpc_service != "", h.Type == "grpc", "grpc"},
+		{"Mysql_user", h.Mysql_user != "", h.Type == "mysql", "mysql"},
+		{"Command", h.Command != "", h.Type == "exec", "exec"},
+	}
+	for _, f := range only {
+		if f.set && !f.ok {
+			return fmt.Errorf("%s only applies to the %s checks", f.field, f.types)
+		}
+	}
+
+	switch h.Type {
+	case "http", "https":
+		if h.Uri != "" {
+			if err := ValidatePath(h.Uri); err != nil {
+				return fmt.Errorf("invalid Uri %q, %s", h.Uri, err.Error())
+			}
+		}
+		for _, s := range strings.Split(h.Valid_statuses, ",") {
+			if s = strings.TrimSpace(s); s != "" && !validStatusCode.MatchString(s) {
+				return fmt.Errorf("invalid status %q in Valid_statuses", s)
+			}
+		}
+		if h.Sni != "" && !validHostname.MatchString(h.Sni) {
+			return fmt.Errorf("invalid Sni %q", h.Sni)
+		}
+	case "grpc":
+		if h.Sni != "" && !validHostname.MatchString(h.Sni) {
+			return fmt.Errorf("invalid Sni %q", h.Sni)
+		}
+		if strings.ContainsAny(h.Grpc_service, " \t\n/") {
+			return fmt.Errorf("invalid Grpc_service %q", h.Grpc_service)
+		}
+	case "mysql":
+		if len(h.Mysql_user) > 32 || strings.ContainsAny(h.Mysql_user, " \t\r\n\x00#'\"\\") {
+			return fmt.Errorf("invalid Mysql_user %q", h.Mysql_user)
+		}
+	case "exec":
+		if err := ValidatePath(h.Command); err != nil {
+			return fmt.Errorf("invalid Command %q, expecting the absolute path of an executable", h.Command)
+		}
+	}
+	return nil
+}
+
+func (p *PassiveCheckCfg) Validate() error {
+	if p.Consecutive_5xx < 0 || p.Consecutive_errors < 0 {
+		return errors.New("Consecutive_5xx and Consecutive_errors must not be negative")
+	}
+	if p.Consecutive_5xx == 0 && p.Consecutive_errors == 0 {
+		return errors.New("one of Consecutive_5xx and Consecutive_errors must be set")
+	}
+	if p.Ejection_time < 0 || p.Ejection_time > 3600000 {
+		return fmt.Errorf("invalid Ejection_time %d, expecting at most an hour in ms", p.Ejection_time)
+	}
+	if p.Max_ejection_percent < 0 || p.Max_ejection_percent > 100 {
+		return fmt.Errorf("invalid Max_ejection_percent %d", p.Max_ejection_percent)
+	}
+	return nil
+}
+
+var (
+	balancerAlgorithms = []string{"round_robin", "weighted_round_robin", "least_conn", "hash", "random_two"}
+	validHeaderName    = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+	// the cookies nginx has a $cookie_ variable for
+	validCookieName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+)
+
+// Validate checks the algorithm and its parameters, the parameters of another
+// algorithm are refused rather than ignored.
+func (b *BalancerCfg) Validate() error {
+	if !contains(balancerAlgorithms, b.Algorithm) {
+		return fmt.Errorf("invalid Algorithm %q, expecting one of %s", b.Algorithm, strings.Join(balancerAlgorithms, ", "))
+	}
+	if len(b.Weights) > 0 && b.Algorithm != "weighted_round_robin" {
+		return errors.New("Weights only apply to the weighted_round_robin algorithm")
+	}
+	if (b.Hash_on != "" || b.Hash_key != "") && b.Algorithm != "hash" {
+		return errors.New("Hash_on and Hash_key only apply to the hash algorithm")
+	}
+
+	switch b.Algorithm {
+	case "weighted_round_robin":
+		if len(b.Weights) == 0 {
+			return errors.New("Weights must not be empty")
+		}
+		for server, weight := range b.Weights {
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				return fmt.Errorf("invalid server %q in Weights, expecting host:port", server)
+			}
+			if weight < 1 || weight > 256 {
+				return fmt.Errorf("invalid weight %d of %s, expecting 1 to 256", weight, server)
+			}
+		}
+	case "hash":
+		switch b.Hash_on {
+		case "header":
+			if !validHeaderName.MatchString(b.Hash_key) {
+				return fmt.Errorf("invalid Hash_key %q, expecting a header name", b.Hash_key)
+			}
+		case "cookie":
+			if !validCookieName.MatchString(b.Hash_key) {
+				return fmt.Errorf("invalid Hash_key %q, expecting a cookie name of letters, digits and _", b.Hash_key)
+			}
+		case "uri":
+			if b.Hash_key != "" {
+				return errors.New("Hash_key does not apply to the uri")
+			}
+		default:
+			return fmt.Errorf("invalid Hash_on %q, expecting header, cookie or uri", b.Hash_on)
+		}
+	}
+	return nil
+}
+
+// Validate checks the cfg before it is written.
+func (c *DomainCfg) Validate() error {
+	if c.Path != "" {
+		if err := ValidatePath(c.Path); err != nil {
+			return fmt.Errorf("invalid Path %q, %s", c.Path, err.Error())
+		}
+	}
+	if c.Balancer != nil {
+		if err := c.Balancer.Validate(); err != nil {
+			return fmt.Errorf("Balancer: %s", err.Error())
+		}
+		// nginx pins the clients of sticky paths with ip_hash, which is an
+		// algorithm of its own
+		if c.Sticky && c.Balancer.Algorithm != "round_robin" {
+			return errors.New("Sticky only applies to the round_robin Balancer")
+		}
+	}
+	if err := c.Healthcheck.Validate(); err != nil {
+		return fmt.Errorf("Healthcheck: %s", err.Error())
+	}
+	if c.Passive != nil {
+		if err := c.Passive.Validate(); err != nil {
+			return fmt.Errorf("Passive: %s", err.Error())
+		}
+	}
+	if c.Service != nil && c.DNS != nil {
+		return errors.New("a path has at most one of Service and DNS")
+	}
+	if c.Service != nil {
+		if err := c.Service.Validate(); err != nil {
+			return fmt.Errorf("Service: %s", err.Error())
+		}
+	}
+	if c.DNS != nil {
+		if err := c.DNS.Validate(); err != nil {
+			return fmt.Errorf("DNS: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// the characters which end a token or a string of the nginx, haproxy and lua
+// configurations the paths are rendered into
+const unsafePathChars = "\"'`{};#\\"
+
+// ValidatePath checks that p is an absolute path which can be rendered as is
+// into the configurations of the data planes: it has no whitespace, control
+// character, quote, brace, semicolon, hash or backslash.
+func ValidatePath(p string) error {
+	if !strings.HasPrefix(p, "/") {
+		return errors.New("expecting an absolute path")
+	}
+	for _, c := range p {
+		if c <= ' ' || c == 0x7f || strings.ContainsRune(unsafePathChars, c) {
+			return fmt.Errorf("unexpected %q", c)
+		}
+	}
+	return nil
+}
+
+// Synced reports whether the servers of the path are synced from a source.
+func (c *DomainCfg) Synced() bool {
+	return c.Service != nil || c.DNS != nil
+}
+
+func (s *ServiceSource) Validate() error {
+	if s.Name == "" {
+		return errors.New("Name must not be empty")
+	}
+	if !validServiceName.MatchString(s.Name) {
+		return fmt.Errorf("invalid Name %q", s.Name)
+	}
+	if err := validateTags(s.Tags); err != nil {
+		return err
+	}
+	if s.Datacenter != "" && !validServiceName.MatchString(s.Datacenter) {
+		return fmt.Errorf("invalid Datacenter %q", s.Datacenter)
+	}
+	return nil
+}
+
+type CookieFilter struct {
+	Name      string `json:"Name" yaml:"name"`
+	Value     string `json:"Value" yaml:"value"`
+	Lifecycle int64  `json:"Lifecycle" yaml:"lifecycle"`
+}
+
+// Validate checks that the name and the value are each a single level of the
+// ckfilter keys.
+func (f *CookieFilter) Validate() error {
+	for _, field := range []struct{ name, v string }{{"Name", f.Name}, {"Value", f.Value}} {
+		if field.v == "" {
+			return fmt.Errorf("%s must not be empty", field.name)
+		}
+		for _, c := range field.v {
+			if c <= ' ' || c == 0x7f || c == '/' {
+				return fmt.Errorf("invalid %s %q, unexpected %q", field.name, field.v, c)
+			}
+		}
+	}
+	return nil
+}
+
+// ServerList is the body of addServers and removeServers.
+type ServerList struct {
+	Path    string   `json:"Path,omitempty"`
+	Servers []string `json:"Servers"`
+}
+
+// Domain is the structured view of everything stored under zlb/<domain>/.
+type Domain struct {
+	Name          string
+	Paths         map[string]*DomainPath
+	CookieFilters []*CookieFilter
+}
+
+// DomainPath groups the cfg and the backend servers of one path of a domain.
+type DomainPath struct {
+	Path    string
+	Cfg     *DomainCfg
+	Servers []string
+}
+
+// EnsurePath returns the path of the domain, adding it when missing.
+func (d *Domain) EnsurePath(path string) *DomainPath {
+	if d.Paths == nil {
+		d.Paths = map[string]*DomainPath{}
+	}
+	p, ok := d.Paths[path]
+	if !ok {
+		p = &DomainPath{Path: path}
+		d.Paths[path] = p
+	}
+	return p
+}
+
+// SortedPaths returns the paths of the domain, longest first, which is the
+// order a prefix matching data plane has to evaluate them in.
+func (d *Domain) SortedPaths() []*DomainPath {
+	paths := make([]*DomainPath, 0, len(d.Paths))
+	for _, p := range d.Paths {
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if len(paths[i].Path) != len(paths[j].Path) {
+			return len(paths[i].Path) > len(paths[j].Path)
+		}
+		return paths[i].Path < paths[j].Path
+	})
+	return paths
+}
+
+// the host names of RFC 1123, with the underscores of SRV names
+var validDNSName = regexp.MustCompile(`^([a-zA-Z0-9_]([a-zA-Z0-9_-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9_]([a-zA-Z0-9_-]{0,61}[a-zA-Z0-9])?\.?$`)
+
+func (s *DNSSource) Validate() error {
+	if s.Name == "" || len(s.Name) > 253 || !validDNSName.MatchString(s.Name) {
+		return fmt.Errorf("invalid Name %q", s.Name)
+	}
+	switch s.Type {
+	case "", "A":
+		if s.Port < 1 || s.Port > 65535 {
+			return fmt.Errorf("invalid Port %d, the servers of A records need one", s.Port)
+		}
+	case "SRV":
+		if s.Port != 0 {
+			return errors.New("the port of the servers of SRV records is in the records")
+		}
+	default:
+		return fmt.Errorf("invalid Type %q (options: A, SRV)", s.Type)
+	}
+	return nil
+}
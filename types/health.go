@@ -0,0 +1,18 @@
+package types
+
+// VersionInfo is the build metadata of the zlb api.
+type VersionInfo struct {
+	Version   string `json:"Version"`
+	GitCommit string `json:"GitCommit"`
+	BuildTime string `json:"BuildTime"`
+	GoVersion string `json:"GoVersion"`
+}
+
+// Readiness is the answer of /readyz.
+type Readiness struct {
+	Ready      bool   `json:"Ready"`
+	Leader     string `json:"Leader,omitempty"`
+	Peers      int    `json:"Peers"`
+	CacheIndex uint64 `json:"CacheIndex"` // 0 until the tree cache has synced
+	Error      string `json:"Error,omitempty"`
+}
@@ -0,0 +1,41 @@
+package types
+
+// KVChange is one key write or delete planned against consul.
+type KVChange struct {
+	Op    string `json:"Op"` // set|delete
+	Key   string `json:"Key"`
+	Old   string `json:"Old,omitempty"`
+	New   string `json:"New,omitempty"`
+	Index uint64 `json:"-"` // ModifyIndex of the old value, 0 if the key does not exist
+}
+
+// ApplyReport is the plan of an apply and whether it was written.
+type ApplyReport struct {
+	Changes []*KVChange `json:"Changes"`
+	DryRun  bool        `json:"DryRun"`
+}
+
+// ImportReport describes the domains found by an import and the keys it
+// writes, or would write on a dry run.
+type ImportReport struct {
+	Domains  []*Domain   `json:"Domains"`
+	Changes  []*KVChange `json:"Changes"`
+	Warnings []string    `json:"Warnings,omitempty"`
+	DryRun   bool        `json:"DryRun"`
+}
+
+// DesiredState is the content of an apply file, in yaml or json.
+type DesiredState struct {
+	Domains []*DomainSpec `json:"Domains" yaml:"domains"`
+}
+
+type DomainSpec struct {
+	Name          string          `json:"Name" yaml:"name"`
+	Paths         []*PathSpec     `json:"Paths" yaml:"paths"`
+	CookieFilters []*CookieFilter `json:"CookieFilters,omitempty" yaml:"cookieFilters"`
+}
+
+type PathSpec struct {
+	DomainCfg `yaml:",inline"`
+	Servers   []string `json:"Servers" yaml:"servers"`
+}
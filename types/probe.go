@@ -0,0 +1,20 @@
+package types
+
+// ProbeResult is the outcome of a health check run by zlb-api against a
+// server.
+type ProbeResult struct {
+	Server     string  `json:"Server"`
+	Up         bool    `json:"Up"`
+	StatusCode int     `json:"StatusCode,omitempty"`
+	LatencyMs  float64 `json:"LatencyMs"`
+	Error      string  `json:"Error,omitempty"`
+}
+
+// PathProbe holds the results of the health check of a domain path against
+// each of its servers.
+type PathProbe struct {
+	Path    string         `json:"Path"`
+	Type    string         `json:"Type"`
+	Skipped string         `json:"Skipped,omitempty"` // why the path was not probed
+	Results []*ProbeResult `json:"Results"`
+}
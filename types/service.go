@@ -0,0 +1,131 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Service is the registration of a service with the consul agent zlb-api
+// talks to. The ID defaults to the name, registering an existing ID replaces
+// the service. The services read back are the instances of the catalog, with
+// the node they run on.
+type Service struct {
+	ID                string          `json:"ID,omitempty"`
+	Node              string          `json:"Node,omitempty"` // set by consul, the node of the agent of the instance
+	Name              string          `json:"Name"`
+	Tags              []string        `json:"Tags"`
+	Address           string          `json:"Address,omitempty"` // the address of the agent's node when empty
+	Port              int             `json:"Port"`
+	EnableTagOverride bool            `json:"EnableTagOverride,omitempty"`
+	Checks            []*ServiceCheck `json:"Checks,omitempty"`
+}
+
+// ServiceCheck is a health check of a service run by the consul agent, it is
+// exactly one of an HTTP, a TCP or a TTL check. Script checks are refused,
+// they would run commands on the agent.
+type ServiceCheck struct {
+	HTTP                           string `json:"HTTP,omitempty"`
+	Method                         string `json:"Method,omitempty"`
+	TLSSkipVerify                  bool   `json:"TLSSkipVerify,omitempty"`
+	TCP                            string `json:"TCP,omitempty"`
+	TTL                            string `json:"TTL,omitempty"`
+	Interval                       string `json:"Interval,omitempty"`
+	Timeout                        string `json:"Timeout,omitempty"`
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter,omitempty"`
+}
+
+var validHostname = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*$`)
+
+func (s *Service) Validate() error {
+	if s.Name == "" {
+		return errors.New("Name must not be empty")
+	}
+	if !validServiceName.MatchString(s.Name) {
+		return fmt.Errorf("invalid Name %q", s.Name)
+	}
+	if s.ID != "" && !validServiceName.MatchString(s.ID) {
+		return fmt.Errorf("invalid ID %q", s.ID)
+	}
+	if s.Address != "" && net.ParseIP(s.Address) == nil && !validHostname.MatchString(s.Address) {
+		return fmt.Errorf("invalid Address %q, expecting an ip or a hostname", s.Address)
+	}
+	if s.Port < 1 || s.Port > 65535 {
+		return fmt.Errorf("invalid Port %d", s.Port)
+	}
+	if err := validateTags(s.Tags); err != nil {
+		return err
+	}
+	for i, c := range s.Checks {
+		if err := c.Validate(); err != nil {
+			return fmt.Errorf("Checks[%d]: %s", i, err.Error())
+		}
+	}
+	return nil
+}
+
+func validateDuration(name, v string, required bool) error {
+	if v == "" {
+		if required {
+			return fmt.Errorf("%s must not be empty", name)
+		}
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", name, v)
+	}
+	if d <= 0 {
+		return fmt.Errorf("%s must be positive", name)
+	}
+	return nil
+}
+
+func (c *ServiceCheck) Validate() error {
+	kinds := 0
+	for _, v := range []string{c.HTTP, c.TCP, c.TTL} {
+		if v != "" {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return errors.New("expecting exactly one of HTTP, TCP and TTL")
+	}
+
+	switch {
+	case c.HTTP != "":
+		u, err := url.Parse(c.HTTP)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid HTTP %q", c.HTTP)
+		}
+		switch strings.ToUpper(c.Method) {
+		case "", "GET", "HEAD", "POST", "PUT", "OPTIONS":
+		default:
+			return fmt.Errorf("invalid Method %q", c.Method)
+		}
+	case c.TCP != "":
+		if _, _, err := net.SplitHostPort(c.TCP); err != nil {
+			return fmt.Errorf("invalid TCP %q, expecting host:port", c.TCP)
+		}
+	}
+	if c.TTL != "" {
+		if c.Interval != "" || c.Timeout != "" {
+			return errors.New("a TTL check has no Interval nor Timeout")
+		}
+		if err := validateDuration("TTL", c.TTL, true); err != nil {
+			return err
+		}
+	} else {
+		if err := validateDuration("Interval", c.Interval, true); err != nil {
+			return err
+		}
+		if err := validateDuration("Timeout", c.Timeout, false); err != nil {
+			return err
+		}
+	}
+	return validateDuration("DeregisterCriticalServiceAfter", c.DeregisterCriticalServiceAfter, false)
+}
@@ -0,0 +1,79 @@
+package types
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// BackendStatus is the state of a backend server of a domain path as seen by
+// the health checks of an LB node.
+type BackendStatus struct {
+	Domain    string `json:"Domain"`
+	Path      string `json:"Path"`
+	Server    string `json:"Server"`
+	Up        bool   `json:"Up"`
+	Since     int64  `json:"Since,omitempty"`     // unix time Up last changed at, kept by zlb-api when 0
+	Rise      int    `json:"Rise,omitempty"`      // consecutive successful checks
+	Fall      int    `json:"Fall,omitempty"`      // consecutive failed checks
+	Checks    uint64 `json:"Checks,omitempty"`    // checks run since the node started
+	Failures  uint64 `json:"Failures,omitempty"`  // failed checks since the node started
+	LastError string `json:"LastError,omitempty"` // of the last failed check
+}
+
+// NodeStatus is the report of an LB node, it replaces the previous report
+// of the node.
+type NodeStatus struct {
+	Node     string           `json:"Node"`
+	Backends []*BackendStatus `json:"Backends"`
+	Time     int64            `json:"Time"`            // set by zlb-api when the report is received
+	Stale    bool             `json:"Stale,omitempty"` // the node has not reported for a while
+}
+
+// DomainHealth aggregates the reports of the nodes about the servers of the
+// paths of a domain.
+type DomainHealth struct {
+	Domain string        `json:"Domain"`
+	Paths  []*PathHealth `json:"Paths"`
+}
+
+type PathHealth struct {
+	Path    string          `json:"Path"`
+	Servers []*ServerHealth `json:"Servers"`
+}
+
+// ServerHealth lists the nodes which see a server up and down, a node which
+// did not report about the server, or whose up report is stale, is in neither.
+type ServerHealth struct {
+	Server string      `json:"Server"`
+	Up     []string    `json:"Up"`
+	Down   []*NodeDown `json:"Down"`
+}
+
+type NodeDown struct {
+	Node      string `json:"Node"`
+	Since     int64  `json:"Since"`
+	LastError string `json:"LastError,omitempty"`
+	Stale     bool   `json:"Stale,omitempty"`
+}
+
+func (s *NodeStatus) Validate() error {
+	if s.Node == "" || strings.ContainsAny(s.Node, "/ \t\n") {
+		return fmt.Errorf("invalid Node %q", s.Node)
+	}
+	for i, b := range s.Backends {
+		if b == nil {
+			return fmt.Errorf("Backends[%d]: must not be null", i)
+		}
+		if b.Domain == "" || strings.Contains(b.Domain, "/") {
+			return fmt.Errorf("Backends[%d]: invalid Domain %q", i, b.Domain)
+		}
+		if _, _, err := net.SplitHostPort(b.Server); err != nil {
+			return fmt.Errorf("Backends[%d]: invalid Server %q, expecting host:port", i, b.Server)
+		}
+		if b.Since < 0 {
+			return fmt.Errorf("Backends[%d]: Since must not be negative", i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package types
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// ChangeEvent describes a single key of the zlb/ tree that was created,
+// updated or deleted.
+type ChangeEvent struct {
+	ID     string `json:"Id"`
+	Type   string `json:"Type"`   // cfg|server|ckfilter
+	Action string `json:"Action"` // create|update|delete
+	Domain string `json:"Domain"`
+	Path   string `json:"Path,omitempty"`
+	Server string `json:"Server,omitempty"`
+	Name   string `json:"Name,omitempty"`
+	Value  string `json:"Value,omitempty"`
+	Key    string `json:"Key"`
+	Old    string `json:"Old,omitempty"`
+	New    string `json:"New,omitempty"`
+	Time   int64  `json:"Time"`
+}
+
+type Webhook struct {
+	ID      string   `json:"Id"`
+	URL     string   `json:"Url"`
+	Secret  string   `json:"Secret,omitempty"`
+	Types   []string `json:"Types,omitempty"`
+	Domains []string `json:"Domains,omitempty"`
+	Created int64    `json:"Created"`
+}
+
+// DeadLetter records an event which could not be delivered to a webhook.
+type DeadLetter struct {
+	Webhook   string       `json:"Webhook"`
+	URL       string       `json:"Url"`
+	Event     *ChangeEvent `json:"Event"`
+	Attempts  int          `json:"Attempts"`
+	LastError string       `json:"LastError"`
+	Time      int64        `json:"Time"`
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Wants reports whether the webhook is subscribed to e.
+func (h *Webhook) Wants(e *ChangeEvent) bool {
+	if len(h.Types) > 0 && !contains(h.Types, e.Type) {
+		return false
+	}
+	if len(h.Domains) > 0 && !contains(h.Domains, e.Domain) {
+		return false
+	}
+	return true
+}
+
+func (h *Webhook) Validate() error {
+	u, err := url.Parse(h.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid webhook url %q", h.URL)
+	}
+	for _, t := range h.Types {
+		if t != "cfg" && t != "server" && t != "ckfilter" {
+			return fmt.Errorf("invalid event type %q (options: cfg, server, ckfilter)", t)
+		}
+	}
+	return nil
+}